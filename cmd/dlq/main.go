@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/app"
+	"github.com/speady1445/learn-pub-sub-starter/internal/config"
+	"github.com/speady1445/learn-pub-sub-starter/internal/pubsub"
+	"github.com/speady1445/learn-pub-sub-starter/internal/routing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func main() {
+	queue_name := flag.String("queue", string(routing.DeadLetterQueue), "dead-letter queue to inspect")
+	limit := flag.Int("limit", 100, "maximum number of messages to look at")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] list | replay <number>...|all | purge\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:], config.ScopeShared)
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	if cfg.PrintOnly {
+		cfg.Print(os.Stdout)
+		return
+	}
+	if cfg.Broker.Kind != "amqp" {
+		log.Fatalf("broker.kind must be amqp, the dead letters of a %s broker are gone with its process", cfg.Broker.Kind)
+	}
+
+	pubsub.RegisterCodec(routing.GameLogCodec{})
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	amqp_config, err := cfg.AMQPConfig()
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	broker, err := pubsub.DialAMQPConfig(cfg.Broker.URL, amqp_config)
+	if err != nil {
+		log.Fatalf("could not connect to RabbitMQ: %v", err)
+	}
+	defer broker.Close()
+
+	switch flag.Arg(0) {
+	case "list":
+		err = list(broker, *queue_name, *limit)
+	case "replay":
+		if flag.NArg() < 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		err = replay(broker, *queue_name, *limit, flag.Args()[1:])
+	case "purge":
+		err = purge(broker, *queue_name)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// list browses the queue: every message is fetched without an ack and
+// requeued in order when the channel closes.
+func list(broker pubsub.Broker, queueName string, limit int) error {
+	channel, err := broker.Channel()
+	if err != nil {
+		return fmt.Errorf("could not open channel: %v", err)
+	}
+	defer channel.Close()
+
+	for number := 1; number <= limit; number++ {
+		delivery, ok, err := channel.Get(queueName, false)
+		if err != nil {
+			return fmt.Errorf("could not get message: %v", err)
+		}
+		if !ok {
+			if number == 1 {
+				fmt.Println("No dead-lettered messages.")
+			}
+			return nil
+		}
+		printMessage(number, delivery)
+	}
+	return nil
+}
+
+// replay republishes the selected messages, numbered as printed by list, to
+// their original exchange and routing key. A message is only removed from
+// the dead-letter queue once the broker confirmed the republish.
+func replay(broker pubsub.Broker, queueName string, limit int, selection []string) error {
+	selected := map[int]bool{}
+	all := len(selection) == 1 && selection[0] == "all"
+	if !all {
+		for _, word := range selection {
+			number, err := strconv.Atoi(word)
+			if err != nil || number < 1 {
+				return fmt.Errorf("%s is not a valid message number", word)
+			}
+			selected[number] = true
+		}
+	}
+
+	channel, err := broker.Channel()
+	if err != nil {
+		return fmt.Errorf("could not open channel: %v", err)
+	}
+	defer channel.Close()
+
+	publisher := pubsub.NewPublisher(broker, pubsub.PublisherOptions{Confirm: true})
+	defer publisher.Close()
+
+	replayed := 0
+	for number := 1; number <= limit; number++ {
+		delivery, ok, err := channel.Get(queueName, false)
+		if err != nil {
+			return fmt.Errorf("could not get message: %v", err)
+		}
+		if !ok {
+			break
+		}
+		if !all && !selected[number] {
+			continue
+		}
+
+		origin := originOf(delivery)
+		ctx, cancel := context.WithTimeout(context.Background(), app.PublishTimeout)
+		err = publisher.Publish(ctx, origin.exchange, origin.routingKey, replayPublishing(delivery))
+		cancel()
+		if err != nil {
+			fmt.Printf("#%d: could not replay to %s (%s): %v\n", number, origin.exchange, origin.routingKey, err)
+			continue
+		}
+		err = delivery.Ack(false)
+		if err != nil {
+			return fmt.Errorf("could not ack message #%d: %v", number, err)
+		}
+		fmt.Printf("#%d: replayed to %s (%s)\n", number, origin.exchange, origin.routingKey)
+		replayed++
+	}
+
+	fmt.Printf("Replayed %d message(s).\n", replayed)
+	return nil
+}
+
+func purge(broker pubsub.Broker, queueName string) error {
+	channel, err := broker.Channel()
+	if err != nil {
+		return fmt.Errorf("could not open channel: %v", err)
+	}
+	defer channel.Close()
+
+	purged, err := channel.QueuePurge(queueName, false)
+	if err != nil {
+		return fmt.Errorf("could not purge queue: %v", err)
+	}
+	fmt.Printf("Purged %d message(s).\n", purged)
+	return nil
+}
+
+// replayPublishing strips the dead-letter bookkeeping headers so that the
+// replayed message is treated like a fresh one. x-death is kept as history.
+func replayPublishing(delivery amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range delivery.Headers {
+		switch k {
+		case "x-first-death-exchange", "x-first-death-queue", "x-first-death-reason",
+			"x-original-exchange", "x-original-routing-key", "x-original-queue",
+			"x-decode-error", "x-decode-attempts", "x-retry-count":
+			continue
+		}
+		headers[k] = v
+	}
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	}
+}
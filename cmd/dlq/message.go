@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/speady1445/learn-pub-sub-starter/internal/pubsub"
+	"github.com/speady1445/learn-pub-sub-starter/internal/routing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type origin struct {
+	exchange   string
+	routingKey string
+	queue      string
+	reason     string
+	count      int64
+	time       time.Time
+}
+
+// originOf works out where a dead-lettered message was originally published.
+// Messages dead-lettered by the subscriber itself carry x-original-* headers,
+// messages nacked to the broker carry x-death entries, newest first. The last
+// entry is the oldest, the first time the message was dead-lettered, which
+// names the exchange it was published to.
+func originOf(delivery amqp.Delivery) origin {
+	o := origin{exchange: delivery.Exchange, routingKey: delivery.RoutingKey}
+
+	deaths, _ := delivery.Headers["x-death"].([]interface{})
+	if len(deaths) > 0 {
+		if death, ok := deaths[len(deaths)-1].(amqp.Table); ok {
+			o.exchange, _ = death["exchange"].(string)
+			o.queue, _ = death["queue"].(string)
+			o.reason, _ = death["reason"].(string)
+			o.time, _ = death["time"].(time.Time)
+			o.count, _ = death["count"].(int64)
+			if keys, ok := death["routing-keys"].([]interface{}); ok && len(keys) > 0 {
+				o.routingKey, _ = keys[0].(string)
+			}
+		}
+	}
+
+	if exchange, ok := delivery.Headers["x-original-exchange"].(string); ok {
+		o.exchange = exchange
+		o.routingKey, _ = delivery.Headers["x-original-routing-key"].(string)
+		o.queue, _ = delivery.Headers["x-original-queue"].(string)
+		if decodeError, ok := delivery.Headers["x-decode-error"].(string); ok {
+			o.reason = "undecodable: " + decodeError
+		} else if retries, ok := delivery.Headers["x-retry-count"]; ok && o.reason == "expired" {
+			// the oldest x-death is the expiry in a retry queue
+			o.reason = fmt.Sprintf("gave up after %v retries", retries)
+		}
+	}
+	return o
+}
+
+func printMessage(number int, delivery amqp.Delivery) {
+	o := originOf(delivery)
+	fmt.Printf("#%d %s (%s) from queue %s\n", number, o.exchange, o.routingKey, o.queue)
+	fmt.Printf("    reason: %s, count: %d", o.reason, o.count)
+	if !o.time.IsZero() {
+		fmt.Printf(", dead-lettered at %s", o.time.Format(time.RFC3339))
+	}
+	fmt.Println()
+	if schema, ok := delivery.Headers[pubsub.SchemaHeader]; ok {
+		fmt.Printf("    schema: %v version %v\n", schema, delivery.Headers[pubsub.SchemaVersionHeader])
+	}
+	if delivery.MessageId != "" || delivery.CorrelationId != "" {
+		fmt.Printf("    message id: %s, correlation id: %s, app: %s\n", delivery.MessageId, delivery.CorrelationId, delivery.AppId)
+	}
+
+	deaths, _ := delivery.Headers["x-death"].([]interface{})
+	for _, d := range deaths {
+		if death, ok := d.(amqp.Table); ok {
+			fmt.Printf("    x-death: queue=%v reason=%v count=%v exchange=%v routing-keys=%v\n",
+				death["queue"], death["reason"], death["count"], death["exchange"], death["routing-keys"])
+		}
+	}
+
+	payload, err := decode(routing.RoutingKey(o.routingKey), delivery.ContentType, delivery.Body)
+	if err != nil {
+		fmt.Printf("    %s: %v\n", delivery.ContentType, err)
+		fmt.Printf("    body: %q\n", truncate(delivery.Body, 200))
+		return
+	}
+	fmt.Printf("    %T: %+v\n", payload, payload)
+}
+
+// decode decodes a body into the game type published under the routing key,
+// with the codec registered for its content type.
+func decode(routingKey routing.RoutingKey, contentType string, body []byte) (any, error) {
+	var payload any
+	switch {
+	case routing.IsArmyMovesKey(routingKey):
+		payload = &gamelogic.ArmyMove{}
+	case routing.IsWarRecognitionsKey(routingKey):
+		payload = &gamelogic.RecognitionOfWar{}
+	case routing.IsGameLogKey(routingKey):
+		payload = &routing.GameLog{}
+	case routingKey == routing.PauseKey:
+		payload = &routing.PlayingState{}
+	default:
+		return nil, fmt.Errorf("unknown routing key %q", routingKey)
+	}
+
+	codec, err := pubsub.CodecFor(contentType)
+	if err != nil {
+		return nil, err
+	}
+	err = codec.Unmarshal(body, payload)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func truncate(body []byte, max int) []byte {
+	if len(body) > max {
+		return body[:max]
+	}
+	return body
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestOriginOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		delivery amqp.Delivery
+		want     origin
+	}{
+		{
+			name: "nacked to the broker",
+			delivery: amqp.Delivery{Exchange: "peril_dlx", RoutingKey: "army_moves.alice", Headers: amqp.Table{
+				"x-death": []interface{}{amqp.Table{
+					"exchange": "peril_topic", "routing-keys": []interface{}{"army_moves.alice"},
+					"queue": "army_moves.bob", "reason": "rejected", "count": int64(1),
+				}},
+			}},
+			want: origin{exchange: "peril_topic", routingKey: "army_moves.alice", queue: "army_moves.bob", reason: "rejected", count: 1},
+		},
+		{
+			// a message that expired in a queue, was dead-lettered to
+			// another one and rejected there: the oldest death, at the end,
+			// is where it was published
+			name: "dead-lettered twice",
+			delivery: amqp.Delivery{Exchange: "peril_dlx", Headers: amqp.Table{
+				"x-death": []interface{}{
+					amqp.Table{"exchange": "delayed", "routing-keys": []interface{}{"war.bob"}, "queue": "war_recognitions", "reason": "rejected", "count": int64(1)},
+					amqp.Table{"exchange": "peril_topic", "routing-keys": []interface{}{"war.alice"}, "queue": "delay", "reason": "expired", "count": int64(2)},
+				},
+			}},
+			want: origin{exchange: "peril_topic", routingKey: "war.alice", queue: "delay", reason: "expired", count: 2},
+		},
+		{
+			name: "dead-lettered by the subscriber",
+			delivery: amqp.Delivery{Exchange: "peril_dlx", RoutingKey: "game_logs.alice", Headers: amqp.Table{
+				"x-original-exchange":    "peril_topic",
+				"x-original-routing-key": "game_logs.alice",
+				"x-original-queue":       "game_logs",
+				"x-decode-error":         "unexpected EOF",
+			}},
+			want: origin{exchange: "peril_topic", routingKey: "game_logs.alice", queue: "game_logs", reason: "undecodable: unexpected EOF"},
+		},
+		{
+			name: "gave up retrying",
+			delivery: amqp.Delivery{Exchange: "peril_dlx", Headers: amqp.Table{
+				"x-death": []interface{}{amqp.Table{
+					"exchange": "", "routing-keys": []interface{}{"game_logs.retry.1000"},
+					"queue": "game_logs.retry.1000", "reason": "expired", "count": int64(5),
+				}},
+				"x-original-exchange":    "peril_topic",
+				"x-original-routing-key": "game_logs.alice",
+				"x-original-queue":       "game_logs",
+				"x-retry-count":          int64(5),
+			}},
+			want: origin{exchange: "peril_topic", routingKey: "game_logs.alice", queue: "game_logs", reason: "gave up after 5 retries", count: 5},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := originOf(test.delivery)
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
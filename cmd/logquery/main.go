@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/gamelogic"
+)
+
+const followInterval = 500 * time.Millisecond
+
+// indexSkew is how much earlier than -since a segment is read from. Its index
+// has the times the server received the records, but they are filtered by
+// the times the clients sent them, by clocks that may be ahead.
+const indexSkew = time.Minute
+
+// filter selects the records to show.
+type filter struct {
+	users    map[string]bool
+	since    time.Time
+	until    time.Time
+	contains string
+}
+
+func (f filter) match(record gamelogic.LogRecord) bool {
+	if len(f.users) > 0 && !f.users[record.Username] {
+		return false
+	}
+	if !f.since.IsZero() && record.CurrentTime.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !record.CurrentTime.Before(f.until) {
+		return false
+	}
+	return strings.Contains(record.Message, f.contains)
+}
+
+func main() {
+	format := flag.String("format", "auto", "format of the game logs: text, jsonl, binary, or auto to go by the file extension")
+	users := flag.String("user", "", "only logs sent by these comma-separated players")
+	since := flag.String("since", "", "only logs from this time on, as RFC3339, a date like 2006-01-02 or a duration ago like 1h")
+	until := flag.String("until", "", "only logs from before this time, as RFC3339, a date like 2006-01-02 or a duration ago like 1h")
+	contains := flag.String("contains", "", "only logs whose message contains this")
+	show_stats := flag.Bool("stats", false, "show per player stats instead of the logs")
+	output := flag.String("output", "table", "output format: table or json")
+	follow := flag.Bool("f", false, "keep reading logs as the server writes them, following rotation")
+	rotated := flag.Bool("rotated", false, "also read the files the game logs were rotated to, oldest first")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [game log file...]\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "The file defaults to game.log.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *format != "auto" && *format != "text" && *format != "jsonl" && *format != "binary" {
+		log.Fatalf("unknown format %q", *format)
+	}
+	if *output != "table" && *output != "json" {
+		log.Fatalf("unknown output %q", *output)
+	}
+
+	f := filter{contains: *contains}
+	if *users != "" {
+		f.users = map[string]bool{}
+		for _, user := range strings.Split(*users, ",") {
+			f.users[strings.TrimSpace(user)] = true
+		}
+	}
+	var err error
+	f.since, err = parseTime(*since)
+	if err != nil {
+		log.Fatalf("invalid -since: %v", err)
+	}
+	f.until, err = parseTime(*until)
+	if err != nil {
+		log.Fatalf("invalid -until: %v", err)
+	}
+
+	paths := flag.Args()
+	if len(paths) == 0 {
+		paths = []string{"game.log"}
+	}
+
+	err = query(paths, *format, f, *show_stats, *output, *follow, *rotated)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseTime parses an RFC3339 time, a date or a duration before now. An empty
+// value is the zero time.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.ParseInLocation(time.DateOnly, value, time.Local)
+	if err == nil {
+		return t, nil
+	}
+	ago, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC3339 time, a date nor a duration", value)
+	}
+	return time.Now().Add(-ago), nil
+}
+
+func query(paths []string, format string, f filter, show_stats bool, output string, follow bool, rotated bool) error {
+	var files []string
+	for _, path := range paths {
+		if rotated {
+			files = append(files, gamelogic.RotatedLogFiles(path)...)
+		}
+		files = append(files, path)
+	}
+
+	sources := []*source{}
+	defer func() {
+		for _, s := range sources {
+			s.close()
+		}
+	}()
+	for _, file := range files {
+		s, err := openSource(file, format)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, s)
+		if !f.since.IsZero() {
+			err = s.skipBefore(f.since.Add(-indexSkew))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	printer := newPrinter(os.Stdout, output)
+	stats := newStats()
+	emit := func(record gamelogic.LogRecord) {
+		if !f.match(record) {
+			return
+		}
+		if show_stats {
+			stats.add(record)
+		} else {
+			printer.add(record)
+		}
+	}
+	flush := func() error {
+		if show_stats {
+			return stats.print(os.Stdout, output)
+		}
+		return printer.flush()
+	}
+
+	for _, s := range sources {
+		err := s.read(emit)
+		if err != nil {
+			return err
+		}
+	}
+	err := flush()
+	if err != nil || !follow {
+		return err
+	}
+
+	// rotated files do not grow, only the files named on the command line
+	live := sources[len(sources)-len(paths):]
+	for {
+		time.Sleep(followInterval)
+		read := 0
+		counting := func(record gamelogic.LogRecord) {
+			read++
+			emit(record)
+		}
+		for _, s := range live {
+			err := s.read(counting)
+			if err != nil {
+				return err
+			}
+			reopened, err := s.reopen()
+			if err != nil {
+				return err
+			}
+			if reopened {
+				err = s.read(counting)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if read == 0 {
+			continue
+		}
+		if show_stats {
+			fmt.Println()
+		}
+		err := flush()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// printer prints records as a table or as JSON Lines.
+type printer struct {
+	output  string
+	table   *tabwriter.Writer
+	encoder *json.Encoder
+	header  bool
+}
+
+func newPrinter(w io.Writer, output string) *printer {
+	return &printer{
+		output:  output,
+		table:   tabwriter.NewWriter(w, 0, 4, 2, ' ', 0),
+		encoder: json.NewEncoder(w),
+	}
+}
+
+func (p *printer) add(record gamelogic.LogRecord) {
+	if p.output == "json" {
+		p.encoder.Encode(record)
+		return
+	}
+	if !p.header {
+		fmt.Fprintln(p.table, "TIME\tPLAYER\tMESSAGE")
+		p.header = true
+	}
+	fmt.Fprintf(p.table, "%s\t%s\t%s\n", record.CurrentTime.Format(time.RFC3339), record.Username, record.Message)
+}
+
+func (p *printer) flush() error {
+	return p.table.Flush()
+}
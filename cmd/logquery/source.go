@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/gamelogic"
+)
+
+// source is a game log file read in one of the formats of the server sinks.
+// It remembers how far it was read, so following it only reads what was
+// appended since.
+type source struct {
+	path   string
+	format string
+	file   *os.File
+	// offset is that of the first record not read yet
+	offset int64
+}
+
+// formatOf picks the format of a file by its extension, as named by the
+// game_log.sinks setting of the server.
+func formatOf(path string) string {
+	switch filepath.Ext(path) {
+	case ".jsonl":
+		return "jsonl"
+	case ".seg":
+		return "binary"
+	default:
+		return "text"
+	}
+}
+
+func openSource(path, format string) (*source, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open game log: %v", err)
+	}
+	if format == "auto" {
+		format = formatOf(path)
+	}
+	return &source{path: path, format: format, file: file}, nil
+}
+
+// skipBefore starts a segment at the first record received at or after
+// since, as found in its index. Other formats are read from the start.
+func (s *source) skipBefore(since time.Time) error {
+	if s.format != "binary" {
+		return nil
+	}
+	offset, err := gamelogic.SegmentOffsetSince(gamelogic.SegmentIndexPath(s.path), since)
+	if err != nil {
+		return err
+	}
+	info, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", s.path, err)
+	}
+	// an index that does not belong to the segment is ignored
+	if offset <= info.Size() {
+		s.offset = offset
+	}
+	return nil
+}
+
+// read passes the records that were completely written since the last read
+// to emit. A record still being written is read by a later call.
+func (s *source) read(emit func(gamelogic.LogRecord)) error {
+	_, err := s.file.Seek(s.offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", s.path, err)
+	}
+	if s.format == "binary" {
+		return s.readSegment(emit)
+	}
+	return s.readLines(emit)
+}
+
+func (s *source) readLines(emit func(gamelogic.LogRecord)) error {
+	reader := bufio.NewReader(s.file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", s.path, err)
+		}
+		s.offset += int64(len(line))
+
+		var record gamelogic.LogRecord
+		if s.format == "jsonl" {
+			err = json.Unmarshal(line, &record)
+		} else {
+			record, err = gamelogic.ParseTextLine(string(line))
+		}
+		if err != nil {
+			log.Printf("skipping a line of %s: %v", s.path, err)
+			continue
+		}
+		emit(record)
+	}
+}
+
+func (s *source) readSegment(emit func(gamelogic.LogRecord)) error {
+	var reader *gamelogic.SegmentReader
+	if s.offset == 0 {
+		var err error
+		reader, err = gamelogic.NewSegmentReader(s.file)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", s.path, err)
+		}
+	} else {
+		reader = gamelogic.ResumeSegmentReader(s.file, s.offset)
+	}
+
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			s.offset = reader.Offset()
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", s.path, err)
+		}
+		emit(record)
+		s.offset = reader.Offset()
+	}
+}
+
+// reopen switches to the file now at the path of the source once the server
+// rotated the one being read, after its remaining records have been read.
+// It starts over if the file was truncated.
+func (s *source) reopen() (bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		// the server has not created the new file yet
+		return false, nil
+	}
+	current, err := s.file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("could not read %s: %v", s.path, err)
+	}
+	if os.SameFile(info, current) {
+		if info.Size() < s.offset {
+			s.offset = 0
+			return true, nil
+		}
+		return false, nil
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return false, fmt.Errorf("could not open game log: %v", err)
+	}
+	s.file.Close()
+	s.file = file
+	s.offset = 0
+	return true, nil
+}
+
+func (s *source) close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/gamelogic"
+)
+
+var testStart = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// writeSegment writes n records received a minute apart, starting at
+// testStart, and returns the path of the segment.
+func writeSegment(t *testing.T, dir string, n int) string {
+	t.Helper()
+	path := filepath.Join(dir, "game.seg")
+	sink, err := gamelogic.NewSegmentSink(path, gamelogic.LogFileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		at := testStart.Add(time.Duration(i) * time.Minute)
+		err = sink.Write([]gamelogic.LogRecord{{CurrentTime: at, ReceivedAt: at, Username: "alice", Message: "log"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readAll(t *testing.T, s *source) []gamelogic.LogRecord {
+	t.Helper()
+	records := []gamelogic.LogRecord{}
+	err := s.read(func(record gamelogic.LogRecord) {
+		records = append(records, record)
+	})
+	if err != nil {
+		t.Fatalf("could not read: %v", err)
+	}
+	return records
+}
+
+func TestSinceSeeksThroughIndex(t *testing.T) {
+	path := writeSegment(t, t.TempDir(), 100)
+	since := testStart.Add(90 * time.Minute)
+
+	s, err := openSource(path, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	err = s.skipBefore(since.Add(-indexSkew))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := readAll(t, s)
+	// the records of the skew before since are read too, and filtered out
+	if len(records) != 11 {
+		t.Fatalf("read %d records, want the 11 from a minute before since", len(records))
+	}
+	f := filter{since: since}
+	matched := 0
+	for _, record := range records {
+		if f.match(record) {
+			matched++
+		}
+	}
+	if matched != 10 {
+		t.Errorf("%d records matched -since, want 10", matched)
+	}
+}
+
+func TestSinceWithoutIndex(t *testing.T) {
+	path := writeSegment(t, t.TempDir(), 10)
+	err := os.Remove(gamelogic.SegmentIndexPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openSource(path, "binary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	err = s.skipBefore(testStart.Add(5 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := readAll(t, s); len(records) != 10 {
+		t.Errorf("read %d records without an index, want all 10", len(records))
+	}
+}
+
+func TestIndexOfAnotherSegmentIsIgnored(t *testing.T) {
+	dir := t.TempDir()
+	path := writeSegment(t, dir, 100)
+	index, err := os.ReadFile(gamelogic.SegmentIndexPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := writeSegment(t, t.TempDir(), 2)
+	err = os.WriteFile(gamelogic.SegmentIndexPath(small), index, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openSource(small, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	err = s.skipBefore(testStart.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := readAll(t, s); len(records) != 2 {
+		t.Errorf("read %d records, want both", len(records))
+	}
+}
+
+func TestTornSegmentTail(t *testing.T) {
+	complete := writeSegment(t, t.TempDir(), 3)
+	data, err := os.ReadFile(complete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "game.seg")
+	cut := len(data) - 5
+	err = os.WriteFile(path, data[:cut], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openSource(path, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if records := readAll(t, s); len(records) != 2 {
+		t.Fatalf("read %d records of a torn segment, want the 2 complete ones", len(records))
+	}
+
+	// the server finishes writing the record
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write(data[cut:])
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := readAll(t, s)
+	if len(records) != 1 || !records[0].ReceivedAt.Equal(testStart.Add(2*time.Minute)) {
+		t.Errorf("read %+v once the record was complete, want the last record", records)
+	}
+}
+
+func TestTornLineTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.jsonl")
+	first := `{"current_time":"2024-03-01T12:00:00Z","username":"alice","message":"one"}` + "\n"
+	second := `{"current_time":"2024-03-01T12:01:00Z","username":"bob","message":"two"}` + "\n"
+	err := os.WriteFile(path, []byte(first+second[:20]), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openSource(path, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if records := readAll(t, s); len(records) != 1 || records[0].Message != "one" {
+		t.Fatalf("got %+v, want only the complete line", records)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteString(second[20:])
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := readAll(t, s); len(records) != 1 || records[0].Message != "two" {
+		t.Errorf("got %+v, want the line once it was complete", records)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	got, err := parseTime("2024-03-01T12:00:00Z")
+	if err != nil || !got.Equal(testStart) {
+		t.Errorf("got %v, %v for an RFC3339 time", got, err)
+	}
+	got, err = parseTime("2024-03-01")
+	if err != nil || got.Day() != 1 || got.Hour() != 0 {
+		t.Errorf("got %v, %v for a date", got, err)
+	}
+	got, err = parseTime("1h")
+	if err != nil || time.Since(got) < time.Hour || time.Since(got) > time.Hour+time.Minute {
+		t.Errorf("got %v, %v for a duration", got, err)
+	}
+	_, err = parseTime("yesterday")
+	if err == nil {
+		t.Error("parsed \"yesterday\"")
+	}
+}
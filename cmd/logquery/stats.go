@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/gamelogic"
+)
+
+type playerStats struct {
+	Player   string `json:"player"`
+	Logs     int    `json:"logs"`
+	WarsWon  int    `json:"wars_won"`
+	WarsLost int    `json:"wars_lost"`
+	Draws    int    `json:"draws"`
+	Spam     int    `json:"spam"`
+}
+
+// stats counts per player the logs they sent, the wars they fought and the
+// spam they sent. Wars are counted for the players named in the log, not for
+// the player who sent it.
+type stats struct {
+	players map[string]*playerStats
+}
+
+func newStats() *stats {
+	return &stats{players: map[string]*playerStats{}}
+}
+
+func (s *stats) player(name string) *playerStats {
+	p, ok := s.players[name]
+	if !ok {
+		p = &playerStats{Player: name}
+		s.players[name] = p
+	}
+	return p
+}
+
+func (s *stats) add(record gamelogic.LogRecord) {
+	sender := s.player(record.Username)
+	sender.Logs++
+	if gamelogic.IsMaliciousLog(record.Message) {
+		sender.Spam++
+		return
+	}
+
+	winner, loser, draw, ok := gamelogic.ParseWarLog(record.Message)
+	if !ok {
+		return
+	}
+	if draw {
+		s.player(winner).Draws++
+		s.player(loser).Draws++
+		return
+	}
+	s.player(winner).WarsWon++
+	s.player(loser).WarsLost++
+}
+
+func (s *stats) sorted() []playerStats {
+	players := make([]playerStats, 0, len(s.players))
+	for _, p := range s.players {
+		players = append(players, *p)
+	}
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].Player < players[j].Player
+	})
+	return players
+}
+
+func (s *stats) print(w io.Writer, output string) error {
+	players := s.sorted()
+	if output == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(players)
+	}
+
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "PLAYER\tLOGS\tWARS WON\tWARS LOST\tDRAWS\tSPAM")
+	for _, p := range players {
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%d\t%d\t%d\n", p.Player, p.Logs, p.WarsWon, p.WarsLost, p.Draws, p.Spam)
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/pubsub"
+)
+
+// managementInspector looks up bindings through the RabbitMQ management HTTP
+// API, since AMQP has no way to list them.
+type managementInspector struct {
+	base     string
+	username string
+	password string
+	vhost    string
+	client   *http.Client
+}
+
+func newManagementInspector(raw, vhost string) (*managementInspector, error) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	inspector := &managementInspector{
+		username: "guest",
+		password: "guest",
+		vhost:    vhost,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	if parsed.User != nil {
+		inspector.username = parsed.User.Username()
+		inspector.password, _ = parsed.User.Password()
+		parsed.User = nil
+	}
+	inspector.base = strings.TrimSuffix(parsed.String(), "/")
+	return inspector, nil
+}
+
+func (m *managementInspector) BindingExists(binding pubsub.BindingSpec) (bool, error) {
+	endpoint := fmt.Sprintf(
+		"%s/api/bindings/%s/e/%s/q/%s",
+		m.base,
+		url.PathEscape(m.vhost),
+		url.PathEscape(binding.Exchange),
+		url.PathEscape(string(binding.Queue)),
+	)
+	request, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return false, err
+	}
+	request.SetBasicAuth(m.username, m.password)
+
+	response, err := m.client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("management API returned %s", response.Status)
+	}
+
+	bindings := []struct {
+		RoutingKey string `json:"routing_key"`
+	}{}
+	err = json.NewDecoder(response.Body).Decode(&bindings)
+	if err != nil {
+		return false, fmt.Errorf("could not decode bindings: %v", err)
+	}
+	for _, existing := range bindings {
+		if existing.RoutingKey == string(binding.Key) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/app"
+)
+
+// startServer builds the server and runs it with the in-memory broker in a
+// directory of its own, returning once it waits for commands. Its input
+// stays open, like a terminal's.
+func startServer(t *testing.T) *exec.Cmd {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds and runs the server")
+	}
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "server")
+	output, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("could not build server: %v\n%s", err, output)
+	}
+
+	cmd := exec.Command(binary, "-broker", "memory")
+	cmd.Dir = dir
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stdin.Close() })
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("could not start server: %v", err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill() })
+
+	ready := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "Possible commands") {
+				close(ready)
+				break
+			}
+		}
+		io.Copy(io.Discard, stdout)
+	}()
+	select {
+	case <-ready:
+	case <-time.After(30 * time.Second):
+		t.Fatal("server did not start")
+	}
+	return cmd
+}
+
+// exitCode waits for the server to exit and returns its exit code.
+func exitCode(t *testing.T, cmd *exec.Cmd) int {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			return exit.ExitCode()
+		}
+		if err != nil {
+			t.Fatalf("could not wait for server: %v", err)
+		}
+		return 0
+	case <-time.After(app.DrainTimeout + 5*time.Second):
+		t.Fatal("server did not exit")
+		return -1
+	}
+}
+
+func TestShutdownOnSignal(t *testing.T) {
+	cmd := startServer(t)
+	err := cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := exitCode(t, cmd); code != 0 {
+		t.Errorf("server exited with %d after SIGTERM, want 0", code)
+	}
+	if _, err := os.Stat(filepath.Join(cmd.Dir, logDedupFile)); err != nil {
+		t.Errorf("dedup store was not kept: %v", err)
+	}
+}
+
+func TestExitOnSecondSignal(t *testing.T) {
+	cmd := startServer(t)
+	// a second SIGTERM could be merged with the first one while both are
+	// pending, so the second signal is a SIGINT
+	for _, sig := range []os.Signal{syscall.SIGTERM, syscall.SIGINT} {
+		err := cmd.Process.Signal(sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	code := exitCode(t, cmd)
+	// pending signals may be delivered in either order
+	if code != app.ExitSignal+int(syscall.SIGINT) && code != app.ExitSignal+int(syscall.SIGTERM) {
+		t.Errorf("server exited with %d after two signals, want 130 or 143", code)
+	}
+}
@@ -0,0 +1,108 @@
+// Package app holds what the Peril binaries share around their own work:
+// connecting to the broker, timeouts, shutting down and exit codes.
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/config"
+	"github.com/speady1445/learn-pub-sub-starter/internal/pubsub"
+	"github.com/speady1445/learn-pub-sub-starter/internal/topology"
+)
+
+const (
+	PublishTimeout = 5 * time.Second
+	DrainTimeout   = 10 * time.Second
+)
+
+// Exit codes besides 0 and the 1 of log.Fatal.
+const (
+	// ExitNotDrained means deliveries were still in flight after
+	// DrainTimeout. The broker redelivers them.
+	ExitNotDrained = 3
+	// A second signal stops shutting down and exits with 128 plus the signal
+	// number, like a shell does.
+	ExitSignal = 128
+)
+
+// Connect connects to the broker configured by cfg and reconnects with
+// pubsub.FailFast. With declare the Peril topology is applied on every
+// connection. A memory broker starts out empty, so it always is.
+func Connect(cfg *config.Config, declare bool) (pubsub.Broker, error) {
+	var dial func() (pubsub.Broker, error)
+	switch cfg.Broker.Kind {
+	case "amqp":
+		amqpConfig, err := cfg.AMQPConfig()
+		if err != nil {
+			return nil, err
+		}
+		dial = func() (pubsub.Broker, error) {
+			return pubsub.DialAMQPConfig(cfg.Broker.URL, amqpConfig)
+		}
+	case "memory":
+		dial = pubsub.NewMemoryBroker().Connect
+		declare = true
+	default:
+		return nil, fmt.Errorf("unknown broker %q", cfg.Broker.Kind)
+	}
+	if !declare {
+		return pubsub.NewManagedBroker(dial, pubsub.ReconnectOptions{Policy: pubsub.FailFast})
+	}
+
+	return pubsub.NewManagedBroker(
+		func() (pubsub.Broker, error) {
+			broker, err := dial()
+			if err != nil {
+				return nil, err
+			}
+			err = topology.Peril().Apply(broker)
+			if err != nil {
+				broker.Close()
+				return nil, fmt.Errorf("could not apply topology: %v", err)
+			}
+			return broker, nil
+		},
+		pubsub.ReconnectOptions{Policy: pubsub.FailFast},
+	)
+}
+
+// CloseSubscriptions stops consuming and waits for in-flight handlers, so
+// quitting never abandons a half-processed delivery. It reports whether all
+// of them were drained within DrainTimeout.
+func CloseSubscriptions(subscriptions []*pubsub.Subscription) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), DrainTimeout)
+	defer cancel()
+
+	drained := true
+	for _, subscription := range subscriptions {
+		err := subscription.Close(ctx)
+		if err != nil {
+			log.Printf("could not close subscription: %v", err)
+			drained = false
+		}
+	}
+	return drained
+}
+
+// NotifyShutdown returns a context that is done once SIGINT or SIGTERM is
+// received. A second signal exits right away with ExitSignal.
+func NotifyShutdown() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Printf("\nReceived %v, shutting down...\n", sig)
+		cancel()
+		sig = <-signals
+		log.Printf("received %v again, exiting without draining", sig)
+		os.Exit(ExitSignal + int(sig.(syscall.Signal)))
+	}()
+	return ctx
+}
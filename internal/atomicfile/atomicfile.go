@@ -0,0 +1,53 @@
+// Package atomicfile rewrites append-only files so that a crash leaves
+// either their old or their new content.
+package atomicfile
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Rewrite replaces the file at path with what write writes, synced before it
+// takes the place of the old one, and returns it opened for appending. old is
+// the file currently open at path: it stays open if the new content could not
+// be written, and is closed otherwise.
+func Rewrite(path string, old *os.File, write func(w *bufio.Writer) error) (*os.File, error) {
+	// unique, so processes sharing the directory do not write over each other
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return old, fmt.Errorf("could not create %s: %v", path, err)
+	}
+	temporary := file.Name()
+	writer := bufio.NewWriter(file)
+	err = write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(temporary)
+		return old, fmt.Errorf("could not write %s: %v", path, err)
+	}
+
+	if old != nil {
+		old.Close()
+	}
+	err = os.Rename(temporary, path)
+	if err != nil {
+		os.Remove(temporary)
+		return nil, fmt.Errorf("could not replace %s: %v", path, err)
+	}
+	file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", path, err)
+	}
+	return file, nil
+}
@@ -0,0 +1,199 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// entry is a setting read from a config file, with its key in the dotted
+// form used by both formats, for example broker.tls.ca_file.
+type entry struct {
+	key   string
+	value string
+	line  int
+}
+
+// readFile reads a config file. Only the part of YAML and TOML needed for
+// settings is understood: nested sections of scalar values and comments.
+func readFile(path string) ([]entry, error) {
+	var parse func([]string) ([]entry, int, error)
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		parse = parseYAML
+	case ".toml":
+		parse = parseTOML
+	default:
+		return nil, fmt.Errorf("config file %s is neither .yaml, .yml nor .toml", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open config file: %v", err)
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %v", err)
+	}
+
+	entries, line, err := parse(lines)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+	}
+	return entries, nil
+}
+
+// parseYAML reads mappings nested by indentation, for example
+//
+//	broker:
+//	  url: amqps://peril.example.com
+//	  tls:
+//	    ca_file: ca.pem
+func parseYAML(lines []string) ([]entry, int, error) {
+	type section struct {
+		indent int
+		key    string
+	}
+	var entries []entry
+	var sections []section
+
+	for i, line := range lines {
+		number := i + 1
+		content := strings.TrimRight(stripComment(line), " \t")
+		trimmed := strings.TrimLeft(content, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, number, fmt.Errorf("tabs are not allowed for indentation")
+		}
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			return nil, number, fmt.Errorf("lists are not supported")
+		}
+		indent := len(content) - len(trimmed)
+
+		for len(sections) > 0 && sections[len(sections)-1].indent >= indent {
+			sections = sections[:len(sections)-1]
+		}
+
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok || (value != "" && value[0] != ' ') {
+			return nil, number, fmt.Errorf("expected key: value")
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if key == "" {
+			return nil, number, fmt.Errorf("missing key")
+		}
+		if len(sections) > 0 {
+			key = sections[len(sections)-1].key + "." + key
+		}
+
+		if value == "" {
+			sections = append(sections, section{indent: indent, key: key})
+			continue
+		}
+		value, err := unquote(value)
+		if err != nil {
+			return nil, number, err
+		}
+		entries = append(entries, entry{key: key, value: value, line: number})
+	}
+	return entries, 0, nil
+}
+
+// parseTOML reads key = value pairs under [section] tables, for example
+//
+//	[broker.tls]
+//	ca_file = "ca.pem"
+func parseTOML(lines []string) ([]entry, int, error) {
+	var entries []entry
+	table := ""
+
+	for i, line := range lines {
+		number := i + 1
+		trimmed := strings.TrimSpace(stripComment(line))
+		if trimmed == "" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "[") {
+			if strings.HasPrefix(trimmed, "[[") || !strings.HasSuffix(trimmed, "]") {
+				return nil, number, fmt.Errorf("expected [table]")
+			}
+			table = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			if table == "" {
+				return nil, number, fmt.Errorf("missing table name")
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(trimmed, "=")
+		if !ok {
+			return nil, number, fmt.Errorf("expected key = value")
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if key == "" {
+			return nil, number, fmt.Errorf("missing key")
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+		value, err := unquote(value)
+		if err != nil {
+			return nil, number, err
+		}
+		entries = append(entries, entry{key: key, value: value, line: number})
+	}
+	return entries, 0, nil
+}
+
+// stripComment removes a # comment that is not inside a quoted string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// unquote returns the content of a double or single quoted string, and
+// other values as they are.
+func unquote(value string) (string, error) {
+	if len(value) == 0 || (value[0] != '"' && value[0] != '\'') {
+		return value, nil
+	}
+	if len(value) < 2 || value[len(value)-1] != value[0] {
+		return "", fmt.Errorf("unterminated string %s", value)
+	}
+	if value[0] == '\'' {
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+	}
+	unquoted, err := strconv.Unquote(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid string %s", value)
+	}
+	return unquoted, nil
+}
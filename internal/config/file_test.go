@@ -0,0 +1,114 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func([]string) ([]entry, int, error)
+		input string
+		want  []entry
+	}{
+		{
+			name:  "yaml nested keys",
+			parse: parseYAML,
+			input: "---\nbroker:\n  url: amqps://host\n  tls:\n    ca_file: ca.pem\n    server_name: host\n  heartbeat: 5s\nchannel:\n  prefetch: 3\n",
+			want: []entry{
+				{key: "broker.url", value: "amqps://host", line: 3},
+				{key: "broker.tls.ca_file", value: "ca.pem", line: 5},
+				{key: "broker.tls.server_name", value: "host", line: 6},
+				{key: "broker.heartbeat", value: "5s", line: 7},
+				{key: "channel.prefetch", value: "3", line: 9},
+			},
+		},
+		{
+			name:  "yaml quoting and comments",
+			parse: parseYAML,
+			input: "# settings\nbroker:\n  url: \"amqp://a#b\" # the broker\n  vhost: 'it''s'\n  kind: \"\\tx\"\n",
+			want: []entry{
+				{key: "broker.url", value: "amqp://a#b", line: 3},
+				{key: "broker.vhost", value: "it's", line: 4},
+				{key: "broker.kind", value: "\tx", line: 5},
+			},
+		},
+		{
+			name:  "yaml dotted key",
+			parse: parseYAML,
+			input: "broker.url: amqp://host\n",
+			want:  []entry{{key: "broker.url", value: "amqp://host", line: 1}},
+		},
+		{
+			name:  "toml tables",
+			parse: parseTOML,
+			input: "heartbeat = 1\n[broker]\nurl = \"amqps://host\"\n\n[broker.tls]\nca_file = \"ca.pem\"\n[ channel ]\nprefetch = 3\n",
+			want: []entry{
+				{key: "heartbeat", value: "1", line: 1},
+				{key: "broker.url", value: "amqps://host", line: 3},
+				{key: "broker.tls.ca_file", value: "ca.pem", line: 6},
+				{key: "channel.prefetch", value: "3", line: 8},
+			},
+		},
+		{
+			name:  "toml quoting and comments",
+			parse: parseTOML,
+			input: "[broker] # connection\nurl = \"amqp://a#b\" # the broker\nvhost = 'x\"y'\nkind = \"say \\\"hi\\\"\"\n",
+			want: []entry{
+				{key: "broker.url", value: "amqp://a#b", line: 2},
+				{key: "broker.vhost", value: "x\"y", line: 3},
+				{key: "broker.kind", value: "say \"hi\"", line: 4},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, _, err := test.parse(strings.Split(test.input, "\n"))
+			if err != nil {
+				t.Fatalf("could not parse: %v", err)
+			}
+			if !reflect.DeepEqual(entries, test.want) {
+				t.Errorf("got %+v, want %+v", entries, test.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func([]string) ([]entry, int, error)
+		input string
+		line  int
+		err   string
+	}{
+		{"yaml tab indentation", parseYAML, "broker:\n\turl: x", 2, "tabs are not allowed"},
+		{"yaml list", parseYAML, "broker:\n  - url", 2, "lists are not supported"},
+		{"yaml missing colon", parseYAML, "broker:\n  url", 2, "expected key: value"},
+		{"yaml colon without space", parseYAML, "url:amqp://host", 1, "expected key: value"},
+		{"yaml missing key", parseYAML, ": x", 1, "missing key"},
+		{"yaml unterminated string", parseYAML, "url: \"amqp://host", 1, "unterminated string"},
+		{"yaml bad escape", parseYAML, "url: \"\\q\"", 1, "invalid string"},
+		{"toml array of tables", parseTOML, "[[broker]]", 1, "expected [table]"},
+		{"toml unclosed table", parseTOML, "\n[broker", 2, "expected [table]"},
+		{"toml empty table", parseTOML, "[ ]", 1, "missing table name"},
+		{"toml missing equals", parseTOML, "[broker]\nurl", 2, "expected key = value"},
+		{"toml missing key", parseTOML, "= 1", 1, "missing key"},
+		{"toml unterminated string", parseTOML, "url = 'x", 1, "unterminated string"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, line, err := test.parse(strings.Split(test.input, "\n"))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got %v, want %q", err, test.err)
+			}
+			if line != test.line {
+				t.Errorf("reported line %d, want %d", line, test.line)
+			}
+		})
+	}
+}
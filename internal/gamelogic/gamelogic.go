@@ -2,6 +2,7 @@ package gamelogic
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -58,20 +59,46 @@ func GetInput() []string {
 	return strings.Fields(line)
 }
 
-func GetMaliciousLog() string {
-	possibleLogs := []string{
-		"Never interrupt your enemy when he is making a mistake.",
-		"The hardest thing of all for a soldier is to retreat.",
-		"A soldier will fight long and hard for a bit of colored ribbon.",
-		"It is well that war is so terrible, otherwise we should grow too fond of it.",
-		"The art of war is simple enough. Find out where your enemy is. Get at him as soon as you can. Strike him as hard as you can, and keep moving on.",
-		"All warfare is based on deception.",
+// GetInputContext is GetInput giving up once ctx is done. It returns nil then
+// and at the end of the input.
+func GetInputContext(ctx context.Context) []string {
+	input := make(chan []string, 1)
+	go func() {
+		input <- GetInput()
+	}()
+	select {
+	case words := <-input:
+		return words
+	case <-ctx.Done():
+		return nil
 	}
-	randomIndex := rand.Intn(len(possibleLogs))
-	msg := possibleLogs[randomIndex]
+}
+
+var maliciousLogs = []string{
+	"Never interrupt your enemy when he is making a mistake.",
+	"The hardest thing of all for a soldier is to retreat.",
+	"A soldier will fight long and hard for a bit of colored ribbon.",
+	"It is well that war is so terrible, otherwise we should grow too fond of it.",
+	"The art of war is simple enough. Find out where your enemy is. Get at him as soon as you can. Strike him as hard as you can, and keep moving on.",
+	"All warfare is based on deception.",
+}
+
+func GetMaliciousLog() string {
+	randomIndex := rand.Intn(len(maliciousLogs))
+	msg := maliciousLogs[randomIndex]
 	return msg
 }
 
+// IsMaliciousLog reports whether message is one of the logs sent by spam.
+func IsMaliciousLog(message string) bool {
+	for _, malicious := range maliciousLogs {
+		if message == malicious {
+			return true
+		}
+	}
+	return false
+}
+
 func PrintQuit() {
 	fmt.Println("I hate this game! (╯°□°)╯︵ ┻━┻")
 }
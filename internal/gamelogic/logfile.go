@@ -0,0 +1,196 @@
+package gamelogic
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupLayout is the time format in the names of rotated files, for example
+// game-2024-04-01T12-00-00.000.log for game.log.
+const backupLayout = "2006-01-02T15-04-05.000"
+
+// LogFileOptions configures the rotation of the files of a sink.
+type LogFileOptions struct {
+	// MaxSize rotates a file before it grows beyond this many bytes. 0
+	// disables it.
+	MaxSize int64
+	// Daily rotates a file when the first log of a new day is written.
+	Daily bool
+	// MaxBackups is the number of rotated files kept, MaxAge how long they
+	// are kept. 0 keeps them regardless.
+	MaxBackups int
+	MaxAge     time.Duration
+}
+
+// logFile is an append-only file that is renamed after the time it was
+// started when it is rotated.
+type logFile struct {
+	path    string
+	options LogFileOptions
+
+	file    *os.File
+	size    int64
+	started time.Time
+}
+
+func openLogFile(path string, options LogFileOptions) (*logFile, error) {
+	f := &logFile{path: path, options: options}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	f.prune()
+	return f, nil
+}
+
+func (f *logFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %v", f.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not open %s: %v", f.path, err)
+	}
+	f.file = file
+	f.size = info.Size()
+	f.started = time.Now()
+	if f.size > 0 {
+		f.started = info.ModTime()
+	}
+	return nil
+}
+
+// due reports whether the file has to be rotated before n more bytes are
+// written to it.
+func (f *logFile) due(n int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.options.MaxSize > 0 && f.size+int64(n) > f.options.MaxSize {
+		return true
+	}
+	return f.options.Daily && !sameDay(f.started, time.Now())
+}
+
+func (f *logFile) write(data []byte) error {
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("could not write to %s: %v", f.path, err)
+	}
+	return nil
+}
+
+func (f *logFile) sync() error {
+	err := f.file.Sync()
+	if err != nil {
+		return fmt.Errorf("could not sync %s: %v", f.path, err)
+	}
+	return nil
+}
+
+func (f *logFile) close() error {
+	return f.file.Close()
+}
+
+// rotate renames the file after started and opens a new one. Files rotated
+// together, like a segment and its index, are given the same start time.
+func (f *logFile) rotate(started time.Time) error {
+	err := f.sync()
+	if err != nil {
+		return err
+	}
+	err = f.file.Close()
+	if err != nil {
+		return err
+	}
+
+	prefix, ext := f.backupPattern()
+	backup := prefix + started.Format(backupLayout) + ext
+	for i := 1; ; i++ {
+		_, err := os.Stat(backup)
+		if err != nil {
+			break
+		}
+		backup = fmt.Sprintf("%s%s.%d%s", prefix, started.Format(backupLayout), i, ext)
+	}
+	renameErr := os.Rename(f.path, backup)
+
+	// without a new file, keep writing to the old one
+	err = f.open()
+	if err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	f.prune()
+	return nil
+}
+
+// backupPattern returns what the names of rotated files start and end with.
+func (f *logFile) backupPattern() (prefix, ext string) {
+	ext = filepath.Ext(f.path)
+	return strings.TrimSuffix(f.path, ext) + "-", ext
+}
+
+// RotatedLogFiles returns the files path was rotated to, oldest first.
+func RotatedLogFiles(path string) []string {
+	f := logFile{path: path}
+	backups := f.backups()
+	names := make([]string, len(backups))
+	for i, b := range backups {
+		names[i] = b.name
+	}
+	return names
+}
+
+type backup struct {
+	name    string
+	started time.Time
+}
+
+// backups returns the rotated files, oldest first.
+func (f *logFile) backups() []backup {
+	prefix, ext := f.backupPattern()
+	names, _ := filepath.Glob(prefix + "*" + ext)
+	var backups []backup
+	for _, name := range names {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		started, err := time.ParseInLocation(backupLayout, stamp[:min(len(stamp), len(backupLayout))], time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{name: name, started: started})
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].started.Before(backups[j].started)
+	})
+	return backups
+}
+
+// prune removes the rotated files beyond MaxBackups and older than MaxAge.
+// Failing to do so is not worth failing a write for, so errors are ignored.
+func (f *logFile) prune() {
+	backups := f.backups()
+	cutoff := time.Now().Add(-f.options.MaxAge)
+	for i, b := range backups {
+		tooMany := f.options.MaxBackups > 0 && len(backups)-i > f.options.MaxBackups
+		tooOld := f.options.MaxAge > 0 && b.started.Before(cutoff)
+		if tooMany || tooOld {
+			os.Remove(b.name)
+		}
+	}
+}
+
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
@@ -0,0 +1,185 @@
+package gamelogic
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTextSink(t *testing.T, options LogFileOptions) (*LineSink, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "game.log")
+	sink, err := NewTextSink(path, options)
+	if err != nil {
+		t.Fatalf("could not open sink: %v", err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	return sink, path
+}
+
+// writeBackup creates a file rotated at started next to path.
+func writeBackup(t *testing.T, path string, started time.Time) string {
+	t.Helper()
+	f := logFile{path: path}
+	prefix, ext := f.backupPattern()
+	name := prefix + started.Format(backupLayout) + ext
+	err := os.WriteFile(name, []byte("rotated\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestLogFileRotatesBySize(t *testing.T) {
+	sink, path := newTestTextSink(t, LogFileOptions{MaxSize: 100})
+	record := LogRecord{CurrentTime: time.Now(), Username: "alice", Message: strings.Repeat("x", 40)}
+
+	for i := 0; i < 5; i++ {
+		err := sink.Write([]LogRecord{record})
+		if err != nil {
+			t.Fatalf("could not write: %v", err)
+		}
+	}
+
+	// lines are about 70 bytes, so every one starts a new file, and the
+	// rotations of a millisecond are numbered
+	rotated := RotatedLogFiles(path)
+	if len(rotated) != 4 {
+		t.Fatalf("got rotated files %v, want 4", rotated)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 100 {
+		t.Errorf("current file has %d bytes, more than MaxSize", info.Size())
+	}
+	for _, name := range append(rotated, path) {
+		data, _ := os.ReadFile(name)
+		if strings.Count(string(data), "\n") != 1 {
+			t.Errorf("%s holds %q, want one line", name, data)
+		}
+	}
+}
+
+func TestLogFileWritesOversizedBatch(t *testing.T) {
+	sink, path := newTestTextSink(t, LogFileOptions{MaxSize: 10})
+	err := sink.Write([]LogRecord{{CurrentTime: time.Now(), Username: "alice", Message: "a message longer than the file may be"}})
+	if err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+	// an empty file is not rotated, the batch is written to it anyway
+	if rotated := RotatedLogFiles(path); len(rotated) != 0 {
+		t.Errorf("got rotated files %v for a single batch", rotated)
+	}
+}
+
+func TestLogFileRotatesDaily(t *testing.T) {
+	sink, path := newTestTextSink(t, LogFileOptions{Daily: true})
+	record := LogRecord{CurrentTime: time.Now(), Username: "alice", Message: "hello"}
+	err := sink.Write([]LogRecord{record})
+	if err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+	if rotated := RotatedLogFiles(path); len(rotated) != 0 {
+		t.Fatalf("rotated %v on the day the file was started", rotated)
+	}
+
+	yesterday := time.Now().AddDate(0, 0, -1)
+	sink.file.started = yesterday
+	err = sink.Write([]LogRecord{record})
+	if err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+	rotated := RotatedLogFiles(path)
+	if len(rotated) != 1 || !strings.Contains(rotated[0], yesterday.Format("2006-01-02")) {
+		t.Errorf("got rotated files %v, want one named after yesterday", rotated)
+	}
+	if !sameDay(sink.file.started, time.Now()) {
+		t.Errorf("new file started %v", sink.file.started)
+	}
+}
+
+func TestLogFileReopenKeepsStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.log")
+	err := os.WriteFile(path, []byte("old\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	yesterday := time.Now().AddDate(0, 0, -1)
+	os.Chtimes(path, yesterday, yesterday)
+
+	// a restart on the next day rotates the file of the day before
+	sink, err := NewTextSink(path, LogFileOptions{Daily: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	err = sink.Write([]LogRecord{{CurrentTime: time.Now(), Username: "alice", Message: "hello"}})
+	if err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+	if rotated := RotatedLogFiles(path); len(rotated) != 1 {
+		t.Errorf("got rotated files %v, want yesterday's", rotated)
+	}
+}
+
+func TestLogFileRetention(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		options LogFileOptions
+		// ages of the rotated files, oldest first, and which are kept
+		ages []time.Duration
+		kept []bool
+	}{
+		{"keep all", LogFileOptions{}, []time.Duration{72 * time.Hour, 48 * time.Hour, time.Hour}, []bool{true, true, true}},
+		{"max backups", LogFileOptions{MaxBackups: 2}, []time.Duration{72 * time.Hour, 48 * time.Hour, time.Hour}, []bool{false, true, true}},
+		{"max age", LogFileOptions{MaxAge: 36 * time.Hour}, []time.Duration{72 * time.Hour, 48 * time.Hour, time.Hour}, []bool{false, false, true}},
+		{"both", LogFileOptions{MaxBackups: 1, MaxAge: 36 * time.Hour}, []time.Duration{72 * time.Hour, 2 * time.Hour, time.Hour}, []bool{false, false, true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "game.log")
+			names := make([]string, len(test.ages))
+			for i, age := range test.ages {
+				names[i] = writeBackup(t, path, now.Add(-age))
+			}
+			// files of other logs are left alone
+			other := filepath.Join(filepath.Dir(path), "game-2.log")
+			os.WriteFile(other, nil, 0o644)
+
+			file, err := openLogFile(path, test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.close()
+
+			for i, name := range names {
+				_, err := os.Stat(name)
+				if exists := err == nil; exists != test.kept[i] {
+					t.Errorf("%s exists: %v, want %v", filepath.Base(name), exists, test.kept[i])
+				}
+			}
+			if _, err := os.Stat(other); err != nil {
+				t.Errorf("removed the log of another instance: %v", err)
+			}
+		})
+	}
+}
+
+func TestLogFilePrunesOnRotation(t *testing.T) {
+	sink, path := newTestTextSink(t, LogFileOptions{MaxSize: 10, MaxBackups: 2})
+	for i := 0; i < 5; i++ {
+		err := sink.Write([]LogRecord{{CurrentTime: time.Now(), Username: "alice", Message: "hello"}})
+		if err != nil {
+			t.Fatalf("could not write: %v", err)
+		}
+	}
+	if rotated := RotatedLogFiles(path); len(rotated) != 2 {
+		t.Errorf("got rotated files %v, want MaxBackups of them", rotated)
+	}
+}
@@ -0,0 +1,91 @@
+package gamelogic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// LineSink writes every record as a line of text.
+type LineSink struct {
+	file   *logFile
+	format func(*bytes.Buffer, LogRecord) error
+}
+
+// NewTextSink writes records as "RFC3339 username: message" lines.
+func NewTextSink(path string, options LogFileOptions) (*LineSink, error) {
+	return newLineSink(path, options, func(buffer *bytes.Buffer, record LogRecord) error {
+		fmt.Fprintf(buffer, "%v %v: %v\n", record.CurrentTime.Format(time.RFC3339), record.Username, record.Message)
+		return nil
+	})
+}
+
+// ParseTextLine parses a line written by the text sink. Only the fields the
+// text format has are set.
+func ParseTextLine(line string) (LogRecord, error) {
+	line = strings.TrimRight(line, "\r\n")
+	stamp, rest, ok := strings.Cut(line, " ")
+	if !ok {
+		return LogRecord{}, fmt.Errorf("not a game log line: %q", line)
+	}
+	currentTime, err := time.Parse(time.RFC3339, stamp)
+	if err != nil {
+		return LogRecord{}, fmt.Errorf("not a game log line: %q", line)
+	}
+	// usernames have no spaces, but messages may contain ": "
+	username, message, ok := strings.Cut(rest, " ")
+	if !ok || !strings.HasSuffix(username, ":") {
+		return LogRecord{}, fmt.Errorf("not a game log line: %q", line)
+	}
+	return LogRecord{
+		CurrentTime: currentTime,
+		Username:    strings.TrimSuffix(username, ":"),
+		Message:     message,
+	}, nil
+}
+
+// NewJSONLinesSink writes records as JSON objects, one per line.
+func NewJSONLinesSink(path string, options LogFileOptions) (*LineSink, error) {
+	return newLineSink(path, options, func(buffer *bytes.Buffer, record LogRecord) error {
+		// Encode ends the object with a newline
+		return json.NewEncoder(buffer).Encode(record)
+	})
+}
+
+func newLineSink(path string, options LogFileOptions, format func(*bytes.Buffer, LogRecord) error) (*LineSink, error) {
+	file, err := openLogFile(path, options)
+	if err != nil {
+		return nil, err
+	}
+	return &LineSink{file: file, format: format}, nil
+}
+
+func (s *LineSink) Write(records []LogRecord) error {
+	var buffer bytes.Buffer
+	for _, record := range records {
+		err := s.format(&buffer, record)
+		if err != nil {
+			return fmt.Errorf("could not format game log: %v", err)
+		}
+	}
+
+	if s.file.due(buffer.Len()) {
+		// a log is better written to a file grown too large than not at all
+		err := s.file.rotate(s.file.started)
+		if err != nil {
+			log.Printf("could not rotate %s: %v", s.file.path, err)
+		}
+	}
+	return s.file.write(buffer.Bytes())
+}
+
+func (s *LineSink) Sync() error {
+	return s.file.sync()
+}
+
+func (s *LineSink) Close() error {
+	return s.file.close()
+}
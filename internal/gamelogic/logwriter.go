@@ -0,0 +1,303 @@
+package gamelogic
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrLogWriterClosed = errors.New("game log writer is closed")
+
+// partialTTL is how long GameLogWriter remembers the sinks that wrote a log
+// whose batch failed on others. A log is usually redelivered within seconds.
+const partialTTL = time.Hour
+
+// LogRecord is a game log as received by the server.
+type LogRecord struct {
+	CurrentTime time.Time `json:"current_time"`
+	Username    string    `json:"username"`
+	Message     string    `json:"message"`
+	RoutingKey  string    `json:"routing_key"`
+	MessageID   string    `json:"message_id"`
+	ReceivedAt  time.Time `json:"received_at"`
+}
+
+// LogSink stores game log records. GameLogWriter calls it from a single
+// goroutine, with the records of a batch at once.
+type LogSink interface {
+	Write(records []LogRecord) error
+	Sync() error
+	Close() error
+}
+
+// SyncPolicy decides when the sinks are fsynced.
+type SyncPolicy string
+
+const (
+	// SyncBatch fsyncs every batch before its writes return, so a log
+	// acknowledged to the broker is on disk.
+	SyncBatch SyncPolicy = "batch"
+	// SyncInterval fsyncs every SyncInterval. Writes return once their batch
+	// is written to the files, so a crash of the machine can lose the logs
+	// of the last interval.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNone leaves it to the operating system.
+	SyncNone SyncPolicy = "none"
+)
+
+type GameLogWriterOptions struct {
+	// BatchSize is the most logs written at once. It defaults to 100.
+	BatchSize int
+	// FlushInterval is how long a log waits for others to be written with.
+	// It defaults to 200 milliseconds.
+	FlushInterval time.Duration
+	// Sync defaults to SyncBatch.
+	Sync SyncPolicy
+	// SyncInterval is used with the SyncInterval policy. It defaults to one
+	// second.
+	SyncInterval time.Duration
+	// WriteDelay is added to every batch, to simulate a slow disk.
+	WriteDelay time.Duration
+}
+
+// GameLogWriter writes game logs to every one of its sinks. Logs written
+// concurrently are batched into a single write, so it is meant to be used
+// by many handlers at once.
+type GameLogWriter struct {
+	sinks   []LogSink
+	options GameLogWriterOptions
+
+	requests  chan logRequest
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+	closeErr  error
+
+	// owned by run
+	dirty   []bool
+	partial map[string]*partialWrite
+}
+
+// partialWrite records which sinks wrote a log, by the index of the sink.
+type partialWrite struct {
+	written []bool
+	since   time.Time
+}
+
+type logRequest struct {
+	record LogRecord
+	done   chan error
+}
+
+// NewGameLogWriter takes over the sinks, closing them when it is closed.
+func NewGameLogWriter(sinks []LogSink, options GameLogWriterOptions) (*GameLogWriter, error) {
+	if options.BatchSize < 1 {
+		options.BatchSize = 100
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = 200 * time.Millisecond
+	}
+	if options.Sync == "" {
+		options.Sync = SyncBatch
+	}
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = time.Second
+	}
+	switch options.Sync {
+	case SyncBatch, SyncInterval, SyncNone:
+	default:
+		return nil, fmt.Errorf("unknown sync policy %q", options.Sync)
+	}
+	if len(sinks) == 0 {
+		return nil, errors.New("no game log sinks")
+	}
+
+	w := &GameLogWriter{
+		sinks:    sinks,
+		options:  options,
+		requests: make(chan logRequest),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+		dirty:    make([]bool, len(sinks)),
+		partial:  map[string]*partialWrite{},
+	}
+	go w.run()
+	return w, nil
+}
+
+// Write writes record and returns once its batch was written to every sink
+// and, with SyncBatch, synced. If a sink failed, the batch was still written
+// to the others, and writing a record with the same MessageID again, as done
+// for a redelivery, only writes it to the sinks that failed.
+func (w *GameLogWriter) Write(record LogRecord) error {
+	r := logRequest{
+		record: record,
+		done:   make(chan error, 1),
+	}
+	select {
+	case w.requests <- r:
+	case <-w.closing:
+		return ErrLogWriterClosed
+	}
+	return <-r.done
+}
+
+// Close writes the logs still waiting and closes the sinks.
+func (w *GameLogWriter) Close() error {
+	w.closeOnce.Do(func() { close(w.closing) })
+	<-w.done
+	return w.closeErr
+}
+
+func (w *GameLogWriter) run() {
+	defer close(w.done)
+
+	var ticks <-chan time.Time
+	if w.options.Sync == SyncInterval {
+		ticker := time.NewTicker(w.options.SyncInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	for {
+		select {
+		case r := <-w.requests:
+			w.flush(w.collect(r))
+		case <-ticks:
+			err := w.sync()
+			if err != nil {
+				log.Print(err)
+			}
+		case <-w.closing:
+			errs := []error{w.sync()}
+			for _, sink := range w.sinks {
+				errs = append(errs, sink.Close())
+			}
+			w.closeErr = errors.Join(errs...)
+			return
+		}
+	}
+}
+
+// collect gathers the requests arriving within the flush interval of the
+// first one, up to the batch size.
+func (w *GameLogWriter) collect(first logRequest) []logRequest {
+	batch := []logRequest{first}
+	timer := time.NewTimer(w.options.FlushInterval)
+	defer timer.Stop()
+	for len(batch) < w.options.BatchSize {
+		select {
+		case r := <-w.requests:
+			batch = append(batch, r)
+		case <-timer.C:
+			return batch
+		case <-w.closing:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (w *GameLogWriter) flush(batch []logRequest) {
+	records := make([]LogRecord, len(batch))
+	for i, r := range batch {
+		records[i] = r.record
+	}
+	err := w.write(records)
+	for _, r := range batch {
+		r.done <- err
+	}
+}
+
+func (w *GameLogWriter) write(records []LogRecord) error {
+	time.Sleep(w.options.WriteDelay)
+
+	var errs []error
+	failed := make([]bool, len(w.sinks))
+	for i, sink := range w.sinks {
+		pending := w.unwritten(i, records)
+		if len(pending) == 0 {
+			continue
+		}
+		err := sink.Write(pending)
+		w.dirty[i] = true
+		if err == nil && w.options.Sync == SyncBatch {
+			err = w.syncSink(i)
+		}
+		if err != nil {
+			failed[i] = true
+			errs = append(errs, err)
+		}
+	}
+	w.track(records, failed)
+	return errors.Join(errs...)
+}
+
+// unwritten returns the records the sink at index i has not written yet.
+func (w *GameLogWriter) unwritten(i int, records []LogRecord) []LogRecord {
+	if len(w.partial) == 0 {
+		return records
+	}
+	var pending []LogRecord
+	for _, record := range records {
+		p, ok := w.partial[record.MessageID]
+		if !ok || !p.written[i] {
+			pending = append(pending, record)
+		}
+	}
+	return pending
+}
+
+// track records the sinks that wrote records if others failed, and forgets
+// the records all of them wrote. Records without a MessageID cannot be told
+// apart, so they are written to every sink again.
+func (w *GameLogWriter) track(records []LogRecord, failed []bool) {
+	now := time.Now()
+	for id, p := range w.partial {
+		if now.Sub(p.since) > partialTTL {
+			delete(w.partial, id)
+		}
+	}
+
+	for _, record := range records {
+		if record.MessageID == "" {
+			continue
+		}
+		p, ok := w.partial[record.MessageID]
+		if !ok {
+			p = &partialWrite{written: make([]bool, len(w.sinks)), since: now}
+		}
+		complete := true
+		for i := range w.sinks {
+			p.written[i] = p.written[i] || !failed[i]
+			complete = complete && p.written[i]
+		}
+		if complete {
+			delete(w.partial, record.MessageID)
+		} else {
+			w.partial[record.MessageID] = p
+		}
+	}
+}
+
+func (w *GameLogWriter) sync() error {
+	var errs []error
+	for i := range w.sinks {
+		errs = append(errs, w.syncSink(i))
+	}
+	return errors.Join(errs...)
+}
+
+func (w *GameLogWriter) syncSink(i int) error {
+	if !w.dirty[i] {
+		return nil
+	}
+	err := w.sinks[i].Sync()
+	if err != nil {
+		return err
+	}
+	w.dirty[i] = false
+	return nil
+}
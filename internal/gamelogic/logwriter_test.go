@@ -0,0 +1,211 @@
+package gamelogic
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink records what it is given. failWrites makes that many writes fail
+// first.
+type fakeSink struct {
+	mu         sync.Mutex
+	batches    [][]LogRecord
+	syncs      int
+	closes     int
+	failWrites int
+}
+
+func (s *fakeSink) Write(records []LogRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failWrites > 0 {
+		s.failWrites--
+		return errors.New("disk full")
+	}
+	s.batches = append(s.batches, records)
+	return nil
+}
+
+func (s *fakeSink) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncs++
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closes++
+	return nil
+}
+
+func (s *fakeSink) records() []LogRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []LogRecord
+	for _, batch := range s.batches {
+		records = append(records, batch...)
+	}
+	return records
+}
+
+func (s *fakeSink) syncCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.syncs
+}
+
+func newTestWriter(t *testing.T, options GameLogWriterOptions, sinks ...LogSink) *GameLogWriter {
+	t.Helper()
+	writer, err := NewGameLogWriter(sinks, options)
+	if err != nil {
+		t.Fatalf("could not create writer: %v", err)
+	}
+	t.Cleanup(func() { writer.Close() })
+	return writer
+}
+
+func testRecord(n int) LogRecord {
+	return LogRecord{Username: "alice", Message: fmt.Sprintf("log %d", n), MessageID: fmt.Sprintf("message-%d", n)}
+}
+
+func TestGameLogWriterBatches(t *testing.T) {
+	sink := &fakeSink{}
+	writer := newTestWriter(t, GameLogWriterOptions{BatchSize: 3, FlushInterval: time.Second}, sink)
+
+	// full batches are written without waiting for the flush interval
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := writer.Write(testRecord(i))
+			if err != nil {
+				t.Errorf("could not write: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("full batches took %v", elapsed)
+	}
+	if len(sink.batches) != 2 || len(sink.batches[0]) != 3 || len(sink.batches[1]) != 3 {
+		t.Errorf("got batches %v, want two of 3", sink.batches)
+	}
+}
+
+func TestGameLogWriterFlushesAfterInterval(t *testing.T) {
+	sink := &fakeSink{}
+	writer := newTestWriter(t, GameLogWriterOptions{BatchSize: 10, FlushInterval: 50 * time.Millisecond}, sink)
+
+	start := time.Now()
+	err := writer.Write(testRecord(1))
+	if err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("a lone log was written after %v, before the flush interval", elapsed)
+	}
+	if len(sink.records()) != 1 {
+		t.Errorf("got %v", sink.records())
+	}
+}
+
+func TestGameLogWriterSyncPolicy(t *testing.T) {
+	tests := []struct {
+		policy SyncPolicy
+		// syncs after the first write returned and after waiting for a
+		// few sync intervals
+		afterWrite int
+		afterWait  int
+	}{
+		{SyncBatch, 1, 1},
+		{SyncInterval, 0, 1},
+		{SyncNone, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			sink := &fakeSink{}
+			writer := newTestWriter(t, GameLogWriterOptions{
+				FlushInterval: time.Millisecond,
+				Sync:          test.policy,
+				SyncInterval:  50 * time.Millisecond,
+			}, sink)
+
+			err := writer.Write(testRecord(1))
+			if err != nil {
+				t.Fatalf("could not write: %v", err)
+			}
+			if got := sink.syncCount(); got != test.afterWrite {
+				t.Errorf("synced %d times once written, want %d", got, test.afterWrite)
+			}
+			// sinks are only synced once after they were written to
+			time.Sleep(200 * time.Millisecond)
+			if got := sink.syncCount(); got != test.afterWait {
+				t.Errorf("synced %d times after waiting, want %d", got, test.afterWait)
+			}
+		})
+	}
+}
+
+func TestGameLogWriterRetriesOnlyFailedSinks(t *testing.T) {
+	healthy := &fakeSink{}
+	failing := &fakeSink{failWrites: 1}
+	writer := newTestWriter(t, GameLogWriterOptions{FlushInterval: time.Millisecond}, healthy, failing)
+
+	record := testRecord(1)
+	err := writer.Write(record)
+	if err == nil {
+		t.Fatal("write succeeded although a sink failed")
+	}
+	// the redelivery is only written to the sink that failed
+	err = writer.Write(record)
+	if err != nil {
+		t.Fatalf("could not write again: %v", err)
+	}
+	if got := healthy.records(); len(got) != 1 {
+		t.Errorf("healthy sink got %v, want the log once", got)
+	}
+	if got := failing.records(); len(got) != 1 {
+		t.Errorf("failing sink got %v, want the log once", got)
+	}
+
+	// once every sink has it, a further write is a new log again
+	err = writer.Write(record)
+	if err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+	if len(healthy.records()) != 2 || len(failing.records()) != 2 {
+		t.Errorf("got %v and %v, want the log twice", healthy.records(), failing.records())
+	}
+}
+
+func TestGameLogWriterCloseIsIdempotent(t *testing.T) {
+	sink := &fakeSink{}
+	writer, err := NewGameLogWriter([]LogSink{sink}, GameLogWriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writer.Close()
+		}()
+	}
+	wg.Wait()
+	if sink.closes != 1 {
+		t.Errorf("sink closed %d times, want once", sink.closes)
+	}
+	err = writer.Write(testRecord(1))
+	if !errors.Is(err, ErrLogWriterClosed) {
+		t.Errorf("got %v after closing, want %v", err, ErrLogWriterClosed)
+	}
+}
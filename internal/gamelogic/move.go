@@ -50,41 +50,79 @@ func getOverlappingLocation(p1 Player, p2 Player) Location {
 }
 
 func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
+	plan, err := gs.PlanMove(words)
+	if err != nil {
+		return ArmyMove{}, err
+	}
+	gs.ApplyMove(plan)
+	return plan.Move, nil
+}
+
+// MovePlan is a validated move that has not changed the game state yet.
+type MovePlan struct {
+	// Units are the moved units at their new location.
+	Units []Unit
+	// Move is the move as it is announced to the other players.
+	Move ArmyMove
+}
+
+func (gs *GameState) PlanMove(words []string) (MovePlan, error) {
 	if gs.isPaused() {
-		return ArmyMove{}, errors.New("the game is paused, you can not move units")
+		return MovePlan{}, errors.New("the game is paused, you can not move units")
 	}
 	if len(words) < 3 {
-		return ArmyMove{}, errors.New("usage: move <location> <unitID> <unitID> <unitID> etc")
+		return MovePlan{}, errors.New("usage: move <location> <unitID> <unitID> <unitID> etc")
 	}
 	newLocation := Location(words[1])
 	locations := getAllLocations()
 	if _, ok := locations[newLocation]; !ok {
-		return ArmyMove{}, fmt.Errorf("error: %s is not a valid location", newLocation)
+		return MovePlan{}, fmt.Errorf("error: %s is not a valid location", newLocation)
 	}
 	unitIDs := []int{}
 	for _, word := range words[2:] {
 		id := word
 		unitID, err := strconv.Atoi(id)
 		if err != nil {
-			return ArmyMove{}, fmt.Errorf("error: %s is not a valid unit ID", id)
+			return MovePlan{}, fmt.Errorf("error: %s is not a valid unit ID", id)
 		}
 		unitIDs = append(unitIDs, unitID)
 	}
 
+	player := gs.GetPlayerSnap()
+	moved := []Unit{}
 	for _, unitID := range unitIDs {
-		unit, ok := gs.GetUnit(unitID)
+		unit, ok := player.Units[unitID]
 		if !ok {
-			return ArmyMove{}, fmt.Errorf("error: unit with ID %v not found", unitID)
+			return MovePlan{}, fmt.Errorf("error: unit with ID %v not found", unitID)
 		}
 		unit.Location = newLocation
-		gs.UpdateUnit(unit)
+		player.Units[unitID] = unit
+		moved = append(moved, unit)
 	}
 
-	mv := ArmyMove{
-		ToLocation: newLocation,
-		Units:      gs.getUnitsSnap(),
-		Player:     gs.GetPlayerSnap(),
+	units := []Unit{}
+	for _, unit := range player.Units {
+		units = append(units, unit)
+	}
+	return MovePlan{
+		Units: moved,
+		Move: ArmyMove{
+			ToLocation: newLocation,
+			Units:      units,
+			Player:     player,
+		},
+	}, nil
+}
+
+// ApplyMove moves the units as planned. Units lost in a war since the move
+// was planned stay lost.
+func (gs *GameState) ApplyMove(plan MovePlan) {
+	gs.mu.Lock()
+	for _, unit := range plan.Units {
+		if _, ok := gs.Player.Units[unit.ID]; ok {
+			gs.Player.Units[unit.ID] = unit
+		}
 	}
-	fmt.Printf("Moved %v units to %s\n", len(mv.Units), mv.ToLocation)
-	return mv, nil
+	gs.mu.Unlock()
+	fmt.Printf("Moved %v units to %s\n", len(plan.Move.Units), plan.Move.ToLocation)
 }
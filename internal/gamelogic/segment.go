@@ -0,0 +1,342 @@
+package gamelogic
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/wire"
+)
+
+// A segment file starts with segmentMagic and the format version, followed
+// by the records. Every record is its payload length and the CRC-32 of the
+// payload, then the payload: the current and the receive time, each as
+// seconds and nanoseconds since the Unix epoch, and the username, message,
+// routing key and message ID, each prefixed with its length. All numbers are
+// big-endian.
+//
+// The index next to a segment has an entry of segmentIndexEntrySize bytes
+// for each record: its receive time in nanoseconds since the Unix epoch and
+// its offset in the segment.
+const (
+	segmentMagic          = "PLSG"
+	segmentVersion        = 1
+	segmentHeaderSize     = 8
+	segmentIndexEntrySize = 16
+
+	// maxSegmentRecordSize guards against allocating a damaged length
+	maxSegmentRecordSize = 16 << 20
+)
+
+var ErrSegmentCorrupt = errors.New("game log segment is corrupt")
+
+// SegmentSink writes records to a binary segment file, with an index of the
+// records by receive time in a file of the same name ending in .idx. A
+// segment and its index are rotated together.
+type SegmentSink struct {
+	segment *logFile
+	index   *logFile
+}
+
+func NewSegmentSink(path string, options LogFileOptions) (*SegmentSink, error) {
+	indexPath := SegmentIndexPath(path)
+	err := recoverSegment(path, indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	segment, err := openLogFile(path, options)
+	if err != nil {
+		return nil, err
+	}
+	index, err := openLogFile(indexPath, options)
+	if err != nil {
+		segment.close()
+		return nil, err
+	}
+	return &SegmentSink{segment: segment, index: index}, nil
+}
+
+// SegmentIndexPath returns the path of the index of a segment.
+func SegmentIndexPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".idx"
+}
+
+func (s *SegmentSink) Write(records []LogRecord) error {
+	payloads := make([][]byte, len(records))
+	size := 0
+	for i, record := range records {
+		payloads[i] = appendSegmentPayload(nil, record)
+		size += 8 + len(payloads[i])
+	}
+
+	if s.segment.due(size) {
+		started := s.segment.started
+		err := s.segment.rotate(started)
+		if err == nil {
+			err = s.index.rotate(started)
+		}
+		if err != nil {
+			log.Printf("could not rotate %s: %v", s.segment.path, err)
+		}
+	}
+
+	var data []byte
+	index := make([]byte, 0, len(records)*segmentIndexEntrySize)
+	if s.segment.size == 0 {
+		data = append(data, segmentMagic...)
+		data = binary.BigEndian.AppendUint32(data, segmentVersion)
+	}
+	for i, payload := range payloads {
+		offset := s.segment.size + int64(len(data))
+		index = binary.BigEndian.AppendUint64(index, uint64(records[i].ReceivedAt.UnixNano()))
+		index = binary.BigEndian.AppendUint64(index, uint64(offset))
+
+		data = binary.BigEndian.AppendUint32(data, uint32(len(payload)))
+		data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(payload))
+		data = append(data, payload...)
+	}
+
+	err := s.segment.write(data)
+	if err != nil {
+		return err
+	}
+	return s.index.write(index)
+}
+
+func (s *SegmentSink) Sync() error {
+	err := s.segment.sync()
+	if err != nil {
+		return err
+	}
+	return s.index.sync()
+}
+
+func (s *SegmentSink) Close() error {
+	return errors.Join(s.segment.close(), s.index.close())
+}
+
+// SegmentOffsetSince looks up in the index of a segment where to start
+// reading it to get the records received at or after since: at the first of
+// them, or at the last record if all were received before. It returns 0, the
+// start of the segment, if the index is missing or empty.
+func SegmentOffsetSince(indexPath string, since time.Time) (int64, error) {
+	file, err := os.Open(indexPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not open %s: %v", indexPath, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	entry := make([]byte, segmentIndexEntrySize)
+	offset := int64(0)
+	for {
+		_, err := io.ReadFull(reader, entry)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// an entry cut short is being written
+			return offset, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("could not read %s: %v", indexPath, err)
+		}
+		// records are written in about the order they were received, so
+		// the first one received since is looked for rather than bisected
+		offset = int64(binary.BigEndian.Uint64(entry[8:]))
+		if !time.Unix(0, int64(binary.BigEndian.Uint64(entry))).Before(since) {
+			return offset, nil
+		}
+	}
+}
+
+// recoverSegment cuts off a record torn by a crash at the end of a segment
+// and rebuilds its index if it does not match the segment.
+func recoverSegment(path, indexPath string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return os.WriteFile(indexPath, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("could not open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("could not open %s: %v", path, err)
+	}
+	if info.Size() < segmentHeaderSize {
+		// torn while the header was written
+		err = os.Truncate(path, 0)
+		if err != nil {
+			return fmt.Errorf("could not truncate %s: %v", path, err)
+		}
+		return os.WriteFile(indexPath, nil, 0644)
+	}
+
+	reader, err := NewSegmentReader(file)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", path, err)
+	}
+	var index []byte
+	end := reader.Offset()
+	for {
+		offset := reader.Offset()
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, ErrSegmentCorrupt) {
+			log.Printf("cutting off a corrupt record at offset %d of %s", offset, path)
+			err = os.Truncate(path, end)
+			if err != nil {
+				return fmt.Errorf("could not truncate %s: %v", path, err)
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", path, err)
+		}
+		index = binary.BigEndian.AppendUint64(index, uint64(record.ReceivedAt.UnixNano()))
+		index = binary.BigEndian.AppendUint64(index, uint64(offset))
+		end = reader.Offset()
+	}
+
+	info, err = os.Stat(indexPath)
+	if err == nil && info.Size() == int64(len(index)) {
+		return nil
+	}
+	err = os.WriteFile(indexPath, index, 0644)
+	if err != nil {
+		return fmt.Errorf("could not rebuild %s: %v", indexPath, err)
+	}
+	return nil
+}
+
+// SegmentReader reads the records of a segment in the order they were
+// written.
+type SegmentReader struct {
+	r      *bufio.Reader
+	offset int64
+	empty  bool
+}
+
+// NewSegmentReader reads the header of the segment read by r. An empty
+// segment has no records.
+func NewSegmentReader(r io.Reader) (*SegmentReader, error) {
+	reader := &SegmentReader{r: bufio.NewReader(r)}
+	header := make([]byte, segmentHeaderSize)
+	n, err := io.ReadFull(reader.r, header)
+	if n == 0 && errors.Is(err, io.EOF) {
+		reader.empty = true
+		return reader, nil
+	}
+	if err != nil || string(header[:4]) != segmentMagic {
+		return nil, errors.New("not a game log segment")
+	}
+	version := binary.BigEndian.Uint32(header[4:])
+	if version != segmentVersion {
+		return nil, fmt.Errorf("unsupported segment version %d", version)
+	}
+	reader.offset = segmentHeaderSize
+	return reader, nil
+}
+
+// ResumeSegmentReader reads the records of a segment from offset on, with r
+// positioned at offset. Offset has to be that of a record, as returned by
+// Offset.
+func ResumeSegmentReader(r io.Reader, offset int64) *SegmentReader {
+	return &SegmentReader{r: bufio.NewReader(r), offset: offset}
+}
+
+// Offset returns the offset of the next record.
+func (r *SegmentReader) Offset() int64 {
+	return r.offset
+}
+
+// Next returns the next record, io.EOF after the last one and
+// ErrSegmentCorrupt for a record that was damaged. The error for a record
+// that ends early also matches io.ErrUnexpectedEOF, since the record may
+// still be being written.
+func (r *SegmentReader) Next() (LogRecord, error) {
+	if r.empty {
+		return LogRecord{}, io.EOF
+	}
+
+	header := make([]byte, 8)
+	n, err := io.ReadFull(r.r, header)
+	if n == 0 && errors.Is(err, io.EOF) {
+		return LogRecord{}, io.EOF
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return LogRecord{}, fmt.Errorf("%w: %w", ErrSegmentCorrupt, io.ErrUnexpectedEOF)
+	}
+	if err != nil {
+		return LogRecord{}, err
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size > maxSegmentRecordSize {
+		return LogRecord{}, fmt.Errorf("%w: record of %d bytes", ErrSegmentCorrupt, size)
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(r.r, payload)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return LogRecord{}, fmt.Errorf("%w: %w", ErrSegmentCorrupt, io.ErrUnexpectedEOF)
+	}
+	if err != nil {
+		return LogRecord{}, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return LogRecord{}, fmt.Errorf("%w: checksum mismatch", ErrSegmentCorrupt)
+	}
+
+	record, err := readSegmentPayload(payload)
+	if err != nil {
+		return LogRecord{}, fmt.Errorf("%w: %v", ErrSegmentCorrupt, err)
+	}
+	r.offset += int64(len(header) + len(payload))
+	return record, nil
+}
+
+func appendSegmentPayload(buffer []byte, record LogRecord) []byte {
+	buffer = wire.AppendTime(buffer, record.CurrentTime)
+	buffer = wire.AppendTime(buffer, record.ReceivedAt)
+	buffer = wire.AppendString(buffer, record.Username)
+	buffer = wire.AppendString(buffer, record.Message)
+	buffer = wire.AppendString(buffer, record.RoutingKey)
+	return wire.AppendString(buffer, record.MessageID)
+}
+
+func readSegmentPayload(payload []byte) (LogRecord, error) {
+	var record LogRecord
+	var err error
+	record.CurrentTime, payload, err = wire.ReadTime(payload)
+	if err != nil {
+		return record, err
+	}
+	record.ReceivedAt, payload, err = wire.ReadTime(payload)
+	if err != nil {
+		return record, err
+	}
+	for _, field := range []*string{&record.Username, &record.Message, &record.RoutingKey, &record.MessageID} {
+		*field, payload, err = wire.ReadString(payload)
+		if err != nil {
+			return record, err
+		}
+	}
+	if len(payload) != 0 {
+		return record, fmt.Errorf("%d trailing bytes", len(payload))
+	}
+	return record, nil
+}
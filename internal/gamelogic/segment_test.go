@@ -0,0 +1,75 @@
+package gamelogic
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSegmentOffsetSince(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.seg")
+	sink, err := NewSegmentSink(path, LogFileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for batch := 0; batch < 3; batch++ {
+		records := make([]LogRecord, 4)
+		for i := range records {
+			n := batch*len(records) + i
+			records[i] = LogRecord{
+				CurrentTime: start.Add(time.Duration(n) * time.Minute),
+				ReceivedAt:  start.Add(time.Duration(n) * time.Minute),
+				Username:    "alice",
+				Message:     fmt.Sprintf("log %d", n),
+			}
+		}
+		err = sink.Write(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		since time.Time
+		want  string
+	}{
+		{start.Add(-time.Hour), "log 0"},
+		{start, "log 0"},
+		{start.Add(5 * time.Minute), "log 5"},
+		{start.Add(5*time.Minute + time.Second), "log 6"},
+		// after the last record, reading starts at it
+		{start.Add(time.Hour), "log 11"},
+	}
+	for _, test := range tests {
+		offset, err := SegmentOffsetSince(SegmentIndexPath(path), test.since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.Seek(offset, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err := ResumeSegmentReader(file, offset).Next()
+		file.Close()
+		if err != nil || record.Message != test.want {
+			t.Errorf("since %v: got %q, %v at offset %d, want %q", test.since, record.Message, err, offset, test.want)
+		}
+	}
+
+	offset, err := SegmentOffsetSince(filepath.Join(t.TempDir(), "missing.idx"), start)
+	if err != nil || offset != 0 {
+		t.Errorf("without an index got offset %d, %v, want 0", offset, err)
+	}
+}
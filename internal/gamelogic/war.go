@@ -2,6 +2,7 @@ package gamelogic
 
 import (
 	"fmt"
+	"strings"
 )
 
 type WarOutcome int
@@ -103,3 +104,26 @@ func unitsToPowerLevel(units []Unit) int {
 	}
 	return power
 }
+
+// WarLog returns the game log announcing the outcome of a war. For a draw,
+// winner and loser are just the two sides.
+func WarLog(outcome WarOutcome, winner, loser string) string {
+	if outcome == WarOutcomeDraw {
+		return fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser)
+	}
+	return fmt.Sprintf("%s won a war against %s", winner, loser)
+}
+
+// ParseWarLog recognizes the game logs of WarLog.
+func ParseWarLog(message string) (winner, loser string, draw bool, ok bool) {
+	if sides, found := strings.CutPrefix(message, "A war between "); found {
+		sides, found = strings.CutSuffix(sides, " resulted in a draw")
+		if !found {
+			return "", "", false, false
+		}
+		winner, loser, ok = strings.Cut(sides, " and ")
+		return winner, loser, true, ok
+	}
+	winner, loser, ok = strings.Cut(message, " won a war against ")
+	return winner, loser, false, ok
+}
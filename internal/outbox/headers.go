@@ -0,0 +1,193 @@
+package outbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Headers is an amqp.Table that keeps the types of its values through the
+// JSON of the journal. Plain JSON would turn every number into a float64,
+// and the int32 schema version would reach consumers as a double.
+type Headers amqp.Table
+
+// typedValue is a header value in the journal, for example
+// {"type":"int32","value":3}.
+type typedValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func (h Headers) MarshalJSON() ([]byte, error) {
+	table, err := encodeTable(amqp.Table(h))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(table)
+}
+
+func (h *Headers) UnmarshalJSON(data []byte) error {
+	var table map[string]typedValue
+	err := json.Unmarshal(data, &table)
+	if err != nil {
+		return err
+	}
+	decoded, err := decodeTable(table)
+	if err != nil {
+		return err
+	}
+	*h = Headers(decoded)
+	return nil
+}
+
+func encodeTable(table amqp.Table) (map[string]typedValue, error) {
+	encoded := make(map[string]typedValue, len(table))
+	for key, value := range table {
+		v, err := encodeValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %v", key, err)
+		}
+		encoded[key] = v
+	}
+	return encoded, nil
+}
+
+func encodeValue(value any) (typedValue, error) {
+	var name string
+	switch v := value.(type) {
+	case nil:
+		return typedValue{Type: "nil"}, nil
+	case bool:
+		name = "bool"
+	case int:
+		name = "int"
+	case int8:
+		name = "int8"
+	case int16:
+		name = "int16"
+	case int32:
+		name = "int32"
+	case int64:
+		name = "int64"
+	case uint8:
+		name = "uint8"
+	case uint16:
+		name = "uint16"
+	case uint32:
+		name = "uint32"
+	case float32:
+		name = "float32"
+	case float64:
+		name = "float64"
+	case string:
+		name = "string"
+	case []byte:
+		name = "bytes"
+	case time.Time:
+		name = "time"
+	case amqp.Decimal:
+		name = "decimal"
+	case amqp.Table:
+		table, err := encodeTable(v)
+		if err != nil {
+			return typedValue{}, err
+		}
+		value, name = table, "table"
+	case []interface{}:
+		items := make([]typedValue, len(v))
+		for i, item := range v {
+			var err error
+			items[i], err = encodeValue(item)
+			if err != nil {
+				return typedValue{}, err
+			}
+		}
+		value, name = items, "array"
+	default:
+		return typedValue{}, fmt.Errorf("unsupported type %T", value)
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return typedValue{}, err
+	}
+	return typedValue{Type: name, Value: encoded}, nil
+}
+
+func decodeTable(table map[string]typedValue) (amqp.Table, error) {
+	decoded := make(amqp.Table, len(table))
+	for key, value := range table {
+		v, err := decodeValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %v", key, err)
+		}
+		decoded[key] = v
+	}
+	return decoded, nil
+}
+
+func decodeValue(value typedValue) (any, error) {
+	switch value.Type {
+	case "nil":
+		return nil, nil
+	case "bool":
+		return decodeAs[bool](value.Value)
+	case "int":
+		return decodeAs[int](value.Value)
+	case "int8":
+		return decodeAs[int8](value.Value)
+	case "int16":
+		return decodeAs[int16](value.Value)
+	case "int32":
+		return decodeAs[int32](value.Value)
+	case "int64":
+		return decodeAs[int64](value.Value)
+	case "uint8":
+		return decodeAs[uint8](value.Value)
+	case "uint16":
+		return decodeAs[uint16](value.Value)
+	case "uint32":
+		return decodeAs[uint32](value.Value)
+	case "float32":
+		return decodeAs[float32](value.Value)
+	case "float64":
+		return decodeAs[float64](value.Value)
+	case "string":
+		return decodeAs[string](value.Value)
+	case "bytes":
+		return decodeAs[[]byte](value.Value)
+	case "time":
+		return decodeAs[time.Time](value.Value)
+	case "decimal":
+		return decodeAs[amqp.Decimal](value.Value)
+	case "table":
+		table, err := decodeAs[map[string]typedValue](value.Value)
+		if err != nil {
+			return nil, err
+		}
+		return decodeTable(table)
+	case "array":
+		items, err := decodeAs[[]typedValue](value.Value)
+		if err != nil {
+			return nil, err
+		}
+		decoded := make([]interface{}, len(items))
+		for i, item := range items {
+			decoded[i], err = decodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return decoded, nil
+	default:
+		return nil, fmt.Errorf("unknown type %q", value.Type)
+	}
+}
+
+func decodeAs[T any](data json.RawMessage) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
@@ -0,0 +1,268 @@
+package outbox
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/atomicfile"
+	"github.com/speady1445/learn-pub-sub-starter/internal/pubsub"
+	"github.com/speady1445/learn-pub-sub-starter/internal/routing"
+)
+
+// Message is an outgoing message recorded in the journal. Its ID is fixed
+// when it is recorded, so a message published again after a crash can be
+// recognized as a duplicate by its consumers.
+type Message struct {
+	ID          string  `json:"id"`
+	Exchange    string  `json:"exchange"`
+	RoutingKey  string  `json:"routing_key"`
+	ContentType string  `json:"content_type"`
+	Headers     Headers `json:"headers,omitempty"`
+	Body        []byte  `json:"body"`
+}
+
+// NewMessage encodes val with codec into a message with a new ID, stamped
+// with the schema of T.
+func NewMessage[T any](exchange string, key routing.RoutingKey, val T, codec pubsub.Codec) (Message, error) {
+	body, err := codec.Marshal(val)
+	if err != nil {
+		return Message{}, fmt.Errorf("error encoding %s: %v", codec.ContentType(), err)
+	}
+	return Message{
+		ID:          newID(),
+		Exchange:    exchange,
+		RoutingKey:  string(key),
+		ContentType: codec.ContentType(),
+		Headers:     Headers(pubsub.SchemaHeaders[T]()),
+		Body:        body,
+	}, nil
+}
+
+// Entry is a state mutation together with the messages announcing it.
+type Entry struct {
+	ID       uint64          `json:"id"`
+	Mutation json.RawMessage `json:"mutation"`
+	Messages []Message       `json:"messages"`
+}
+
+// record is a line of the journal file: either an entry, or the ID of an
+// entry whose messages were all published.
+type record struct {
+	Entry *Entry  `json:"entry,omitempty"`
+	Done  *uint64 `json:"done,omitempty"`
+}
+
+// Journal is an append-only file of entries. An entry is written and synced
+// with a single line, so a mutation is either recorded completely together
+// with its messages or not at all. On open, the entries not marked done yet
+// are pending again, their mutations are applied again and the file is
+// rewritten with only those entries.
+type Journal struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	next    uint64
+	pending []Entry
+	done    int
+}
+
+// Open opens the journal at path and calls apply with the mutation of every
+// pending entry, oldest first, before anything can be published. The process
+// may have stopped between recording a mutation and applying it, or lost its
+// state since, so mutations must be safe to apply more than once.
+func Open(path string, apply func(mutation json.RawMessage) error) (*Journal, error) {
+	j := &Journal{path: path, next: 1}
+
+	err := j.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range j.pending {
+		err := apply(entry.Mutation)
+		if err != nil {
+			return nil, fmt.Errorf("could not replay journal entry %d: %v", entry.ID, err)
+		}
+	}
+	err = j.compact()
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not open journal: %v", err)
+	}
+	defer file.Close()
+
+	entries := map[uint64]Entry{}
+	order := []uint64{}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// a last line without newline was cut short by a crash, and
+			// its entry was never applied
+			break
+		}
+		var r record
+		err = json.Unmarshal(line, &r)
+		if err != nil {
+			return fmt.Errorf("could not read journal: %v", err)
+		}
+		switch {
+		case r.Entry != nil:
+			entries[r.Entry.ID] = *r.Entry
+			order = append(order, r.Entry.ID)
+			j.next = max(j.next, r.Entry.ID+1)
+		case r.Done != nil:
+			delete(entries, *r.Done)
+		}
+	}
+
+	for _, id := range order {
+		if entry, ok := entries[id]; ok {
+			j.pending = append(j.pending, entry)
+		}
+	}
+	return nil
+}
+
+// Append records mutation and its messages. The mutation must only be
+// applied once Append has returned without error.
+func (j *Journal) Append(mutation any, messages []Message) (Entry, error) {
+	encoded, err := json.Marshal(mutation)
+	if err != nil {
+		return Entry{}, fmt.Errorf("could not encode mutation: %v", err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return Entry{}, os.ErrClosed
+	}
+
+	entry := Entry{ID: j.next, Mutation: encoded, Messages: messages}
+	err = j.write(record{Entry: &entry})
+	if err != nil {
+		return Entry{}, err
+	}
+	err = j.file.Sync()
+	if err != nil {
+		return Entry{}, fmt.Errorf("could not sync journal: %v", err)
+	}
+
+	j.next++
+	j.pending = append(j.pending, entry)
+	return entry, nil
+}
+
+// MarkDone records that every message of the entry was published. The
+// marker is not synced: after a crash the entry is published again, which
+// is harmless for consumers that deduplicate by message ID.
+func (j *Journal) MarkDone(id uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return os.ErrClosed
+	}
+
+	err := j.write(record{Done: &id})
+	if err != nil {
+		return err
+	}
+	for i, entry := range j.pending {
+		if entry.ID == id {
+			j.pending = append(j.pending[:i:i], j.pending[i+1:]...)
+			break
+		}
+	}
+
+	j.done++
+	if len(j.pending) == 0 && j.done >= compactAfter {
+		return j.compactLocked()
+	}
+	return nil
+}
+
+// compactAfter is the number of done markers after which an idle journal is
+// truncated.
+const compactAfter = 1000
+
+// Pending returns the entries whose messages have not all been published,
+// oldest first.
+func (j *Journal) Pending() []Entry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]Entry{}, j.pending...)
+}
+
+func (j *Journal) write(r record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("could not encode journal record: %v", err)
+	}
+	_, err = j.file.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("could not write journal: %v", err)
+	}
+	return nil
+}
+
+func (j *Journal) compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.compactLocked()
+}
+
+// compactLocked replaces the file with one holding only the pending entries
+// and reopens it for appending.
+func (j *Journal) compactLocked() error {
+	var err error
+	j.file, err = atomicfile.Rewrite(j.path, j.file, func(w *bufio.Writer) error {
+		encoder := json.NewEncoder(w)
+		for i := range j.pending {
+			err := encoder.Encode(record{Entry: &j.pending[i]})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not compact journal: %v", err)
+	}
+	j.done = 0
+	return nil
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+func newID() string {
+	buffer := make([]byte, 16)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		panic(fmt.Sprintf("could not generate id: %v", err))
+	}
+	return hex.EncodeToString(buffer)
+}
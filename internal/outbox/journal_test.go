@@ -0,0 +1,307 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/pubsub"
+	"github.com/speady1445/learn-pub-sub-starter/internal/routing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type testMove struct {
+	Unit     int
+	Location string
+}
+
+// openTest opens the journal at path and returns it with the mutations it
+// replayed.
+func openTest(t *testing.T, path string) (*Journal, []testMove) {
+	t.Helper()
+	replayed := []testMove{}
+	journal, err := Open(path, func(mutation json.RawMessage) error {
+		var move testMove
+		err := json.Unmarshal(mutation, &move)
+		if err != nil {
+			return err
+		}
+		replayed = append(replayed, move)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not open journal: %v", err)
+	}
+	t.Cleanup(func() { journal.Close() })
+	return journal, replayed
+}
+
+func newTestMessage(t *testing.T, move testMove) Message {
+	t.Helper()
+	message, err := NewMessage("test_topic", routing.RoutingKey("moves."+move.Location), move, pubsub.JSONCodec{})
+	if err != nil {
+		t.Fatalf("could not create message: %v", err)
+	}
+	return message
+}
+
+func TestAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.outbox")
+	journal, replayed := openTest(t, path)
+	if len(replayed) != 0 {
+		t.Fatalf("new journal replayed %v", replayed)
+	}
+
+	moves := []testMove{{1, "europe"}, {2, "asia"}}
+	for i, move := range moves {
+		entry, err := journal.Append(move, []Message{newTestMessage(t, move)})
+		if err != nil {
+			t.Fatalf("could not append: %v", err)
+		}
+		if entry.ID != uint64(i+1) {
+			t.Errorf("entry %d has ID %d", i+1, entry.ID)
+		}
+	}
+
+	pending := journal.Pending()
+	if len(pending) != 2 {
+		t.Fatalf("got %d pending entries, want 2", len(pending))
+	}
+	for i, entry := range pending {
+		var move testMove
+		json.Unmarshal(entry.Mutation, &move)
+		if move != moves[i] || entry.Messages[0].RoutingKey != "moves."+moves[i].Location {
+			t.Errorf("entry %d holds %+v with %+v, want %+v", i, move, entry.Messages, moves[i])
+		}
+	}
+
+	// every entry is a single line, with its mutation and its messages
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"mutation"`) || !strings.Contains(lines[0], `"messages"`) {
+		t.Errorf("journal file:\n%s", data)
+	}
+}
+
+func TestReplayAfterCrashBetweenAppendAndPublish(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.outbox")
+	journal, _ := openTest(t, path)
+	move := testMove{1, "europe"}
+	appended, err := journal.Append(move, []Message{newTestMessage(t, move)})
+	if err != nil {
+		t.Fatalf("could not append: %v", err)
+	}
+	// the process stops before the move is applied or published
+	journal.Close()
+
+	journal, replayed := openTest(t, path)
+	if !reflect.DeepEqual(replayed, []testMove{move}) {
+		t.Fatalf("replayed %v, want %v", replayed, move)
+	}
+	pending := journal.Pending()
+	if len(pending) != 1 || pending[0].Messages[0].ID != appended.Messages[0].ID {
+		t.Fatalf("pending %+v, want the entry with its message ID kept for deduplication", pending)
+	}
+
+	// the relay publishes it once the journal is open again
+	broker, err := pubsub.NewMemoryBroker().Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	err = pubsub.Topology{
+		Exchanges: []pubsub.ExchangeSpec{{Name: "test_topic", Kind: amqp.ExchangeTopic}},
+		Queues:    []pubsub.QueueSpec{{Name: "moves"}},
+		Bindings:  []pubsub.BindingSpec{{Queue: "moves", Exchange: "test_topic", Key: "moves.*"}},
+	}.Apply(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher := pubsub.NewPublisher(broker, pubsub.PublisherOptions{Confirm: true})
+	defer publisher.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewRelay(journal, publisher).Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	channel, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		delivery, ok, err := channel.Get("moves", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			if delivery.MessageId != appended.Messages[0].ID {
+				t.Errorf("got message %s, want %s", delivery.MessageId, appended.Messages[0].ID)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("relay did not publish the replayed entry")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for len(journal.Pending()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("published entry was not marked done")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	journal.Close()
+	_, replayed = openTest(t, path)
+	if len(replayed) != 0 {
+		t.Errorf("replayed %v after the entry was published", replayed)
+	}
+}
+
+func TestReplaySkipsDoneEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.outbox")
+	journal, _ := openTest(t, path)
+	moves := []testMove{{1, "europe"}, {2, "asia"}, {3, "africa"}}
+	for _, move := range moves {
+		_, err := journal.Append(move, []Message{newTestMessage(t, move)})
+		if err != nil {
+			t.Fatalf("could not append: %v", err)
+		}
+	}
+	journal.MarkDone(2)
+	journal.Close()
+
+	// a line cut short by a crash was never applied and is ignored
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"entry":{"id":4,"mutation":{"Unit":4`)
+	file.Close()
+
+	journal, replayed := openTest(t, path)
+	want := []testMove{moves[0], moves[2]}
+	if !reflect.DeepEqual(replayed, want) {
+		t.Errorf("replayed %v, want %v in order", replayed, want)
+	}
+	entry, err := journal.Append(testMove{5, "europe"}, nil)
+	if err != nil {
+		t.Fatalf("could not append: %v", err)
+	}
+	if entry.ID != 4 {
+		t.Errorf("appended entry %d after a restart, want 4", entry.ID)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.outbox")
+	journal, _ := openTest(t, path)
+	for i := 1; i <= compactAfter; i++ {
+		_, err := journal.Append(testMove{i, "europe"}, nil)
+		if err != nil {
+			t.Fatalf("could not append: %v", err)
+		}
+		if i == compactAfter {
+			// the journal is not idle yet
+			break
+		}
+		journal.MarkDone(uint64(i))
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() == 0 {
+		t.Fatal("journal was compacted with an entry pending")
+	}
+
+	journal.MarkDone(compactAfter)
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("idle journal holds %d bytes after %d done markers, want it truncated", info.Size(), compactAfter)
+	}
+
+	// open rewrites the file with only the pending entries
+	for i := 1; i <= 2; i++ {
+		_, err := journal.Append(testMove{i, "asia"}, nil)
+		if err != nil {
+			t.Fatalf("could not append: %v", err)
+		}
+	}
+	journal.MarkDone(compactAfter + 1)
+	journal.Close()
+	openTest(t, path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(data), "\n") != 1 || !strings.Contains(string(data), `"id":1002`) {
+		t.Errorf("reopened journal holds:\n%s", data)
+	}
+}
+
+func TestHeadersKeepTypes(t *testing.T) {
+	headers := Headers{
+		"nil":     nil,
+		"bool":    true,
+		"int":     -1,
+		"int8":    int8(-8),
+		"int16":   int16(-16),
+		"int32":   int32(32),
+		"int64":   int64(1) << 60,
+		"uint8":   uint8(8),
+		"uint16":  uint16(16),
+		"uint32":  uint32(32),
+		"float32": float32(1.5),
+		"float64": 2.25,
+		"string":  "text",
+		"bytes":   []byte{0, 1, 2},
+		"time":    time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		"decimal": amqp.Decimal{Scale: 2, Value: 314},
+		"table":   amqp.Table{"count": int32(3)},
+		"array":   []interface{}{int64(1), "two", amqp.Table{"three": int16(3)}},
+	}
+
+	data, err := json.Marshal(headers)
+	if err != nil {
+		t.Fatalf("could not encode: %v", err)
+	}
+	var decoded Headers
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatalf("could not decode: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, headers) {
+		t.Errorf("round trip\n got %#v\nwant %#v", decoded, headers)
+	}
+
+	_, err = json.Marshal(Headers{"channel": make(chan int)})
+	if err == nil {
+		t.Error("encoded a header of an unsupported type")
+	}
+	err = json.Unmarshal([]byte(`{"x":{"type":"complex","value":1}}`), &decoded)
+	if err == nil {
+		t.Error("decoded a header of an unknown type")
+	}
+}
@@ -0,0 +1,106 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/pubsub"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	publishTimeout = 5 * time.Second
+	minBackoff     = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+)
+
+// Relay publishes the pending entries of a journal in order and marks them
+// done. The publisher should use confirms, otherwise an entry is marked done
+// as soon as its messages were handed to the broker.
+type Relay struct {
+	journal   *Journal
+	publisher *pubsub.Publisher
+	wake      chan struct{}
+}
+
+func NewRelay(journal *Journal, publisher *pubsub.Publisher) *Relay {
+	return &Relay{
+		journal:   journal,
+		publisher: publisher,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Notify tells the relay that an entry was appended.
+func (r *Relay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run publishes pending entries until ctx is cancelled, starting with the
+// ones left over from before a restart. A failed publish is retried with
+// exponential backoff, so entries are never published out of order.
+func (r *Relay) Run(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		err := r.flush(ctx)
+		if err == nil {
+			backoff = minBackoff
+			select {
+			case <-r.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("could not relay outbox: %v", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+func (r *Relay) flush(ctx context.Context) error {
+	for _, entry := range r.journal.Pending() {
+		for _, message := range entry.Messages {
+			err := r.publish(ctx, message)
+			var returned *pubsub.ReturnedError
+			if errors.As(err, &returned) {
+				// nobody is listening, publishing again will not change that
+				log.Printf("outbox message %s was not routed: %v", message.ID, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		err := r.journal.MarkDone(entry.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Relay) publish(ctx context.Context, message Message) error {
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+	return r.publisher.Publish(ctx, message.Exchange, message.RoutingKey, amqp.Publishing{
+		MessageId:   message.ID,
+		ContentType: message.ContentType,
+		Headers:     amqp.Table(message.Headers),
+		Body:        message.Body,
+	})
+}
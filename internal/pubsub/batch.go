@@ -0,0 +1,184 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// BatchError reports the messages of a batch that could not be published.
+type BatchError struct {
+	Total  int
+	Failed []FailedMessage
+}
+
+// FailedMessage is a message of a batch, identified by its index, and the
+// reason it was not published.
+type FailedMessage struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d of %d messages failed, first at index %d: %v", len(e.Failed), e.Total, e.Failed[0].Index, e.Failed[0].Err)
+}
+
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, failed := range e.Failed {
+		errs[i] = failed.Err
+	}
+	return errs
+}
+
+// newBatchError returns a *BatchError for the non-nil errors, or nil if
+// there are none.
+func newBatchError(errs []error) error {
+	batchErr := &BatchError{Total: len(errs)}
+	for i, err := range errs {
+		if err != nil {
+			batchErr.Failed = append(batchErr.Failed, FailedMessage{Index: i, Err: err})
+		}
+	}
+	if len(batchErr.Failed) == 0 {
+		return nil
+	}
+	return batchErr
+}
+
+// PublishBatch publishes msgs in order on a single channel. In confirm mode
+// the confirms are collected while publishing rather than awaited one at a
+// time. It returns a *BatchError for the messages that failed.
+func (p *Publisher) PublishBatch(ctx context.Context, exchange, key string, msgs []amqp.Publishing) error {
+	for i := range msgs {
+		p.prepare(ctx, &msgs[i])
+	}
+	errs := make([]error, len(msgs))
+	fail := func(from int, err error) error {
+		for i := from; i < len(msgs); i++ {
+			errs[i] = err
+		}
+		return newBatchError(errs)
+	}
+
+	pc, err := p.take(ctx)
+	if err != nil {
+		return fail(0, err)
+	}
+	defer func() {
+		p.idle <- pc
+	}()
+	channel, err := p.acquire(ctx, pc)
+	if err != nil {
+		return fail(0, err)
+	}
+
+	var sent chan int
+	var confirmed chan []error
+	if p.options.Confirm {
+		ids := make(map[string]int, len(msgs))
+		for i, msg := range msgs {
+			ids[msg.MessageId] = i
+		}
+		sent = make(chan int, 1)
+		confirmed = make(chan []error, 1)
+		go func() {
+			confirmed <- pc.collectConfirms(ctx, ids, len(msgs), sent)
+		}()
+	}
+
+	published := len(msgs)
+	for i, msg := range msgs {
+		err := channel.PublishWithContext(ctx, exchange, key, p.options.Confirm, false, msg)
+		if err != nil {
+			published = i
+			fail(i, err)
+			break
+		}
+	}
+	if !p.options.Confirm {
+		if published < len(msgs) {
+			pc.release()
+		}
+		return newBatchError(errs)
+	}
+
+	sent <- published
+	for i, err := range <-confirmed {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+	if published < len(msgs) {
+		// confirms of messages published after the failure would be
+		// matched to the next ones
+		pc.release()
+	}
+	return newBatchError(errs)
+}
+
+// collectConfirms receives the confirms of a batch until all of the messages
+// that were published, as reported on sent, are confirmed. Confirms arrive
+// in publishing order, returns are matched by message ID.
+func (pc *publisherChannel) collectConfirms(ctx context.Context, ids map[string]int, total int, sent chan int) []error {
+	errs := make([]error, total)
+	returned := func(r amqp.Return) {
+		if i, ok := ids[r.MessageId]; ok {
+			errs[i] = &ReturnedError{
+				Exchange:   r.Exchange,
+				RoutingKey: r.RoutingKey,
+				ReplyCode:  r.ReplyCode,
+				ReplyText:  r.ReplyText,
+			}
+		}
+	}
+
+	published := -1
+	next := 0
+	returns := pc.returns
+	for published < 0 || next < published {
+		select {
+		case published = <-sent:
+			sent = nil
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			returned(r)
+		case confirmation, ok := <-pc.confirms:
+			if !ok {
+				pc.release()
+				for i := next; i < total; i++ {
+					errs[i] = ErrConfirmChannelLost
+				}
+				return errs
+			}
+			if !confirmation.Ack {
+				errs[next] = ErrNacked
+			}
+			next++
+		case <-ctx.Done():
+			// late confirms would be matched to the next messages
+			pc.release()
+			for i := next; i < total; i++ {
+				errs[i] = ctx.Err()
+			}
+			return errs
+		}
+	}
+
+	// the broker sends basic.return before the ack of the same message
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				return errs
+			}
+			returned(r)
+		default:
+			return errs
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// lateConfirmBroker opens channels whose confirms only arrive when they are
+// closed, and like those of the amqp library, Close blocks until they are
+// delivered.
+type lateConfirmBroker struct {
+	Broker
+}
+
+func (b lateConfirmBroker) Channel() (Channel, error) {
+	channel, err := b.Broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return &lateConfirmChannel{Channel: channel}, nil
+}
+
+type lateConfirmChannel struct {
+	Channel
+	confirms  chan amqp.Confirmation
+	published uint64
+}
+
+func (ch *lateConfirmChannel) NotifyPublish(confirms chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.confirms = confirms
+	return confirms
+}
+
+func (ch *lateConfirmChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.published++
+	return ch.Channel.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+func (ch *lateConfirmChannel) Close() error {
+	for tag := uint64(1); tag <= ch.published; tag++ {
+		ch.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+	}
+	close(ch.confirms)
+	return ch.Channel.Close()
+}
+
+func TestPublishBatchCancelledReleasesChannel(t *testing.T) {
+	broker, channel := newSubscribeTest(t)
+	declareBoundQueue(t, channel, testQueue, testExchange, testKey, nil)
+	publisher := NewPublisher(lateConfirmBroker{broker}, PublisherOptions{Confirm: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	msgs := make([]amqp.Publishing, 10)
+	done := make(chan error, 1)
+	go func() {
+		err := publisher.PublishBatch(ctx, testExchange, testKey, msgs)
+		publisher.Close()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		batchErr, ok := err.(*BatchError)
+		if !ok || len(batchErr.Failed) != len(msgs) {
+			t.Errorf("got %v, want every message to fail", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("releasing the channel blocked on its unread confirms")
+	}
+}
+
+const benchmarkBatchSize = 100
+
+// BenchmarkPublishBatch and BenchmarkPublishLoop publish the same messages
+// with confirms, as a batch and one message at a time.
+func BenchmarkPublishBatch(b *testing.B) {
+	publisher, msgs := newPublishBenchmark(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := PublishBatch(context.Background(), publisher, testExchange, testKey, msgs)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPublishLoop(b *testing.B) {
+	publisher, msgs := newPublishBenchmark(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, msg := range msgs {
+			err := Publish(context.Background(), publisher, testExchange, testKey, msg)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// newPublishBenchmark returns a confirming publisher and a batch of
+// messages, whose queue is purged as they arrive.
+func newPublishBenchmark(b *testing.B) (*Publisher, []testMessage) {
+	broker, channel := newSubscribeTest(b)
+	declareBoundQueue(b, channel, testQueue, testExchange, testKey, nil)
+	publisher := NewPublisher(broker, PublisherOptions{Confirm: true})
+	b.Cleanup(func() { publisher.Close() })
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				channel.QueuePurge(testQueue, false)
+			}
+		}
+	}()
+	b.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+
+	msgs := make([]testMessage, benchmarkBatchSize)
+	for i := range msgs {
+		msgs[i] = testMessage{Key: "bench", Sequence: i}
+	}
+	return publisher, msgs
+}
@@ -0,0 +1,81 @@
+package pubsub
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Broker is a connection to a message broker. The AMQP implementation wraps
+// an *amqp.Connection, MemoryBroker provides an in-process one.
+type Broker interface {
+	Channel() (Channel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// Channel is the subset of *amqp.Channel used by this package. Deliveries are
+// acked and nacked through their Acknowledger, so amqp.Delivery.Ack and
+// amqp.Delivery.Nack work with every implementation.
+type Channel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	QueueUnbind(name, key, exchange string, args amqp.Table) error
+	QueuePurge(name string, noWait bool) (int, error)
+	QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(returns chan amqp.Return) chan amqp.Return
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+type amqpBroker struct {
+	connection *amqp.Connection
+}
+
+func DialAMQP(url string) (Broker, error) {
+	connection, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewAMQPBroker(connection), nil
+}
+
+// DialAMQPConfig dials like DialAMQP with the TLS, heartbeat, vhost and
+// channel settings of config.
+func DialAMQPConfig(url string, config amqp.Config) (Broker, error) {
+	connection, err := amqp.DialConfig(url, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewAMQPBroker(connection), nil
+}
+
+func NewAMQPBroker(connection *amqp.Connection) Broker {
+	return &amqpBroker{connection: connection}
+}
+
+func (b *amqpBroker) Channel() (Channel, error) {
+	channel, err := b.connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+func (b *amqpBroker) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	return b.connection.NotifyClose(receiver)
+}
+
+func (b *amqpBroker) Close() error {
+	return b.connection.Close()
+}
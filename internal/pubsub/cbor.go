@@ -0,0 +1,398 @@
+package pubsub
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// CBORCodec encodes messages as CBOR (RFC 8949). Times are written as
+// RFC 3339 strings with tag 0, which keeps their precision and offset, and
+// epoch times with tag 1 are accepted as well.
+type CBORCodec struct{}
+
+func (CBORCodec) ContentType() string {
+	return ContentTypeCBOR
+}
+
+func (CBORCodec) Marshal(v any) ([]byte, error) {
+	w := &cborWriter{}
+	err := encodeValue(w, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return w.buffer, nil
+}
+
+func (CBORCodec) Unmarshal(data []byte, v any) error {
+	r := &cborReader{data: data}
+	decoded, err := r.read(0)
+	if err != nil {
+		return err
+	}
+	if decoded == cborBreak {
+		return errors.New("cbor: unexpected break")
+	}
+	if r.offset != len(data) {
+		return fmt.Errorf("cbor: %d trailing bytes", len(data)-r.offset)
+	}
+	return unmarshalValue(decoded, v)
+}
+
+const (
+	cborUnsigned = 0 << 5
+	cborNegative = 1 << 5
+	cborBytes    = 2 << 5
+	cborText     = 3 << 5
+	cborArray    = 4 << 5
+	cborMap      = 5 << 5
+	cborTag      = 6 << 5
+	cborSimple   = 7 << 5
+
+	cborTagTimeString = 0
+	cborTagTimeEpoch  = 1
+)
+
+type cborWriter struct {
+	buffer []byte
+}
+
+func (w *cborWriter) head(major byte, n uint64) {
+	switch {
+	case n < 24:
+		w.buffer = append(w.buffer, major|byte(n))
+	case n <= math.MaxUint8:
+		w.buffer = append(w.buffer, major|24, byte(n))
+	case n <= math.MaxUint16:
+		w.buffer = binary.BigEndian.AppendUint16(append(w.buffer, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		w.buffer = binary.BigEndian.AppendUint32(append(w.buffer, major|26), uint32(n))
+	default:
+		w.buffer = binary.BigEndian.AppendUint64(append(w.buffer, major|27), n)
+	}
+}
+
+func (w *cborWriter) writeNil() {
+	w.buffer = append(w.buffer, cborSimple|22)
+}
+
+func (w *cborWriter) writeBool(v bool) {
+	if v {
+		w.buffer = append(w.buffer, cborSimple|21)
+	} else {
+		w.buffer = append(w.buffer, cborSimple|20)
+	}
+}
+
+func (w *cborWriter) writeInt(v int64) {
+	if v >= 0 {
+		w.head(cborUnsigned, uint64(v))
+	} else {
+		w.head(cborNegative, uint64(-1-v))
+	}
+}
+
+func (w *cborWriter) writeUint(v uint64) {
+	w.head(cborUnsigned, v)
+}
+
+func (w *cborWriter) writeFloat(v float64) {
+	w.buffer = binary.BigEndian.AppendUint64(append(w.buffer, cborSimple|27), math.Float64bits(v))
+}
+
+func (w *cborWriter) writeString(v string) {
+	w.head(cborText, uint64(len(v)))
+	w.buffer = append(w.buffer, v...)
+}
+
+func (w *cborWriter) writeBytes(v []byte) {
+	w.head(cborBytes, uint64(len(v)))
+	w.buffer = append(w.buffer, v...)
+}
+
+func (w *cborWriter) writeTime(v time.Time) {
+	w.head(cborTag, cborTagTimeString)
+	w.writeString(v.Format(time.RFC3339Nano))
+}
+
+func (w *cborWriter) writeArrayHeader(n int) {
+	w.head(cborArray, uint64(n))
+}
+
+func (w *cborWriter) writeMapHeader(n int) {
+	w.head(cborMap, uint64(n))
+}
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+// cborBreak is returned by read for the break code ending an indefinite
+// length item.
+var cborBreak = &struct{}{}
+
+type cborReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *cborReader) take(n uint64) ([]byte, error) {
+	if uint64(len(r.data)-r.offset) < n {
+		return nil, errCBORTruncated
+	}
+	b := r.data[r.offset : r.offset+int(n)]
+	r.offset += int(n)
+	return b, nil
+}
+
+// argument reads the argument of an item head. indefinite is set for
+// additional information 31.
+func (r *cborReader) argument(info byte) (n uint64, indefinite bool, err error) {
+	switch {
+	case info < 24:
+		return uint64(info), false, nil
+	case info == 31:
+		return 0, true, nil
+	case info > 27:
+		return 0, false, fmt.Errorf("cbor: invalid additional information %d", info)
+	}
+
+	b, err := r.take(1 << (info - 24))
+	if err != nil {
+		return 0, false, err
+	}
+	switch info {
+	case 24:
+		return uint64(b[0]), false, nil
+	case 25:
+		return uint64(binary.BigEndian.Uint16(b)), false, nil
+	case 26:
+		return uint64(binary.BigEndian.Uint32(b)), false, nil
+	default:
+		return binary.BigEndian.Uint64(b), false, nil
+	}
+}
+
+func (r *cborReader) read(depth int) (any, error) {
+	if depth > maxDecodeDepth {
+		return nil, errors.New("cbor: data nested too deeply")
+	}
+	b, err := r.take(1)
+	if err != nil {
+		return nil, err
+	}
+	major, info := b[0]&0xe0, b[0]&0x1f
+
+	if major == cborSimple {
+		return r.simple(info)
+	}
+
+	n, indefinite, err := r.argument(info)
+	if err != nil {
+		return nil, err
+	}
+	if indefinite && (major == cborUnsigned || major == cborNegative || major == cborTag) {
+		return nil, fmt.Errorf("cbor: invalid indefinite length for major type %d", major>>5)
+	}
+
+	switch major {
+	case cborUnsigned:
+		return n, nil
+	case cborNegative:
+		if n > math.MaxInt64 {
+			return nil, errors.New("cbor: negative integer out of range")
+		}
+		return -1 - int64(n), nil
+
+	case cborBytes, cborText:
+		var data []byte
+		if indefinite {
+			data, err = r.chunks(major)
+		} else {
+			data, err = r.take(n)
+			data = append([]byte{}, data...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if major == cborText {
+			return string(data), nil
+		}
+		return data, nil
+
+	case cborArray:
+		// every item takes at least one byte
+		if !indefinite && n > uint64(len(r.data)-r.offset) {
+			return nil, errCBORTruncated
+		}
+		items := []any{}
+		for i := uint64(0); indefinite || i < n; i++ {
+			item, err := r.read(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if item == cborBreak {
+				if !indefinite {
+					return nil, errors.New("cbor: unexpected break")
+				}
+				break
+			}
+			items = append(items, item)
+		}
+		return items, nil
+
+	case cborMap:
+		if !indefinite && n > uint64(len(r.data)-r.offset)/2 {
+			return nil, errCBORTruncated
+		}
+		entries := []mapEntry{}
+		for i := uint64(0); indefinite || i < n; i++ {
+			key, err := r.read(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if key == cborBreak {
+				if !indefinite {
+					return nil, errors.New("cbor: unexpected break")
+				}
+				break
+			}
+			value, err := r.read(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if value == cborBreak {
+				return nil, errors.New("cbor: unexpected break")
+			}
+			entries = append(entries, mapEntry{key: key, value: value})
+		}
+		return entries, nil
+
+	default:
+		content, err := r.read(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return r.tagged(n, content)
+	}
+}
+
+// chunks concatenates the definite length chunks of an indefinite length
+// byte or text string.
+func (r *cborReader) chunks(major byte) ([]byte, error) {
+	data := []byte{}
+	for {
+		b, err := r.take(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == cborSimple|31 {
+			return data, nil
+		}
+		if b[0]&0xe0 != major {
+			return nil, errors.New("cbor: invalid chunk in indefinite length string")
+		}
+		n, indefinite, err := r.argument(b[0] & 0x1f)
+		if err != nil {
+			return nil, err
+		}
+		if indefinite {
+			return nil, errors.New("cbor: nested indefinite length string")
+		}
+		chunk, err := r.take(n)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+}
+
+func (r *cborReader) simple(info byte) (any, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		b, err := r.take(2)
+		if err != nil {
+			return nil, err
+		}
+		return halfFloat(binary.BigEndian.Uint16(b)), nil
+	case 26:
+		b, err := r.take(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 27:
+		b, err := r.take(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case 31:
+		return cborBreak, nil
+	}
+	return nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+}
+
+// tagged interprets the date/time tags. Other tags are ignored and their
+// content is used as is.
+func (r *cborReader) tagged(tag uint64, content any) (any, error) {
+	if content == cborBreak {
+		return nil, errors.New("cbor: unexpected break")
+	}
+	switch tag {
+	case cborTagTimeString:
+		s, ok := content.(string)
+		if !ok {
+			return nil, errors.New("cbor: tag 0 requires a text string")
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, fmt.Errorf("cbor: %v", err)
+		}
+		return t, nil
+	case cborTagTimeEpoch:
+		switch c := content.(type) {
+		case uint64:
+			if c > math.MaxInt64 {
+				return nil, errors.New("cbor: epoch time out of range")
+			}
+			return time.Unix(int64(c), 0), nil
+		case int64:
+			return time.Unix(c, 0), nil
+		case float64:
+			seconds, fraction := math.Modf(c)
+			return time.Unix(int64(seconds), int64(fraction*1e9)), nil
+		}
+		return nil, errors.New("cbor: tag 1 requires a number")
+	}
+	return content, nil
+}
+
+func halfFloat(h uint16) float64 {
+	exponent := int(h>>10) & 0x1f
+	mantissa := float64(h & 0x3ff)
+	var value float64
+	switch exponent {
+	case 0:
+		value = math.Ldexp(mantissa, -24)
+	case 31:
+		if mantissa == 0 {
+			value = math.Inf(1)
+		} else {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mantissa+1024, exponent-25)
+	}
+	if h&0x8000 != 0 {
+		return -value
+	}
+	return value
+}
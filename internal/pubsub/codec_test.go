@@ -0,0 +1,271 @@
+package pubsub
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var binaryCodecs = []Codec{MsgPackCodec{}, CBORCodec{}}
+
+type codecNested struct {
+	Name  string
+	Tags  []string
+	Inner *codecNested
+}
+
+type codecKinds struct {
+	Bool    bool
+	Int     int
+	Int8    int8
+	Int16   int16
+	Int32   int32
+	Int64   int64
+	Uint    uint
+	Uint8   uint8
+	Uint16  uint16
+	Uint32  uint32
+	Uint64  uint64
+	Float32 float32
+	Float64 float64
+	String  string
+	Bytes   []byte
+	Slice   []int
+	Array   [3]string
+	Map     map[string]int
+	IntMap  map[int]string
+	Nested  codecNested
+	Pointer *codecNested
+	NilPtr  *codecNested
+	Structs []codecNested
+	Any     any
+	Time    time.Time
+	Times   map[string]time.Time
+
+	unexported int
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	want := codecKinds{
+		Bool:    true,
+		Int:     math.MinInt64,
+		Int8:    math.MinInt8,
+		Int16:   math.MaxInt16,
+		Int32:   math.MinInt32,
+		Int64:   math.MaxInt64,
+		Uint:    math.MaxUint64,
+		Uint8:   math.MaxUint8,
+		Uint16:  math.MaxUint16,
+		Uint32:  math.MaxUint32,
+		Uint64:  math.MaxUint64,
+		Float32: 1.5,
+		Float64: -math.Pi,
+		String:  "peril ☠",
+		Bytes:   []byte{0, 1, 0xff},
+		Slice:   []int{-1, 0, 1 << 40},
+		Array:   [3]string{"a", "", "c"},
+		Map:     map[string]int{"europe": 3, "asia": -2},
+		IntMap:  map[int]string{-5: "minus", 500: "plus"},
+		Nested: codecNested{
+			Name:  "outer",
+			Tags:  []string{"x"},
+			Inner: &codecNested{Name: "inner", Tags: []string{}},
+		},
+		Pointer: &codecNested{Name: "pointer"},
+		Structs: []codecNested{{Name: "first"}, {Name: "second", Tags: []string{"y", "z"}}},
+		Any:     map[string]any{"list": []any{"a", true, nil}},
+		Time:    time.Date(2024, 3, 1, 12, 30, 15, 123456789, time.UTC),
+		Times:   map[string]time.Time{"epoch": time.Unix(0, 0).UTC()},
+	}
+
+	for _, codec := range binaryCodecs {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			data, err := codec.Marshal(want)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			var got codecKinds
+			err = codec.Unmarshal(data, &got)
+			if err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+
+			if !got.Time.Equal(want.Time) {
+				t.Errorf("Time = %v, want %v", got.Time, want.Time)
+			}
+			if !got.Times["epoch"].Equal(want.Times["epoch"]) {
+				t.Errorf("Times = %v, want %v", got.Times, want.Times)
+			}
+			got.Time, got.Times = want.Time, want.Times
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip\n got %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestCodecIntegerWidths(t *testing.T) {
+	// values on both sides of every boundary where the encodings switch to
+	// a wider form
+	signed := []int64{
+		math.MinInt64, math.MinInt32 - 1, math.MinInt32, math.MinInt16 - 1, math.MinInt16,
+		math.MinInt8 - 1, math.MinInt8, -33, -32, -25, -24, -1,
+		0, 1, 23, 24, 127, 128, 255, 256, math.MaxInt16, math.MaxUint16, math.MaxUint16 + 1,
+		math.MaxInt32, math.MaxUint32, math.MaxUint32 + 1, math.MaxInt64,
+	}
+	unsigned := []uint64{0, 23, 24, 255, 256, math.MaxUint16, math.MaxUint16 + 1, math.MaxUint32, math.MaxUint32 + 1, math.MaxUint64}
+
+	for _, codec := range binaryCodecs {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			for _, want := range signed {
+				data, err := codec.Marshal(want)
+				if err != nil {
+					t.Fatalf("Marshal(%d): %v", want, err)
+				}
+				var got int64
+				err = codec.Unmarshal(data, &got)
+				if err != nil || got != want {
+					t.Errorf("round trip of %d = %d, %v", want, got, err)
+				}
+			}
+			for _, want := range unsigned {
+				data, err := codec.Marshal(want)
+				if err != nil {
+					t.Fatalf("Marshal(%d): %v", want, err)
+				}
+				var got uint64
+				err = codec.Unmarshal(data, &got)
+				if err != nil || got != want {
+					t.Errorf("round trip of %d = %d, %v", want, got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCodecOverflow(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		into  any
+	}{
+		{"int8 above max", int64(math.MaxInt8 + 1), new(int8)},
+		{"int8 below min", int64(math.MinInt8 - 1), new(int8)},
+		{"int32 above max", int64(math.MaxInt32 + 1), new(int32)},
+		{"int64 from max uint64", uint64(math.MaxUint64), new(int64)},
+		{"uint8 above max", uint64(math.MaxUint8 + 1), new(uint8)},
+		{"uint16 above max", uint64(math.MaxUint16 + 1), new(uint16)},
+		{"uint from negative", int64(-1), new(uint)},
+		{"string into int", "ten", new(int)},
+		{"array length", []int{1, 2}, new([3]int)},
+	}
+
+	for _, codec := range binaryCodecs {
+		for _, tt := range tests {
+			t.Run(codec.ContentType()+"/"+tt.name, func(t *testing.T) {
+				data, err := codec.Marshal(tt.value)
+				if err != nil {
+					t.Fatalf("Marshal: %v", err)
+				}
+				err = codec.Unmarshal(data, tt.into)
+				if err == nil {
+					t.Errorf("decoding %v into %T succeeded", tt.value, tt.into)
+				}
+			})
+		}
+	}
+}
+
+func TestCodecTruncated(t *testing.T) {
+	value := codecKinds{
+		Int64:   math.MinInt64,
+		Uint64:  math.MaxUint64,
+		Float64: 1.25,
+		String:  strings.Repeat("s", 300),
+		Bytes:   bytes.Repeat([]byte{7}, 70000),
+		Slice:   make([]int, 20),
+		Map:     map[string]int{"a": 1},
+		Pointer: &codecNested{Name: "p"},
+		Time:    time.Date(2024, 3, 1, 12, 0, 0, 1, time.UTC),
+	}
+
+	for _, codec := range binaryCodecs {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			data, err := codec.Marshal(value)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			for n := 0; n < len(data); n++ {
+				var got codecKinds
+				if codec.Unmarshal(data[:n], &got) == nil {
+					t.Fatalf("decoding the first %d of %d bytes succeeded", n, len(data))
+				}
+			}
+			var got codecKinds
+			if codec.Unmarshal(append(data, 0), &got) == nil {
+				t.Error("decoding with a trailing byte succeeded")
+			}
+		})
+	}
+}
+
+func TestCodecMalformed(t *testing.T) {
+	deepMsgPack := append(bytes.Repeat([]byte{0x91}, maxDecodeDepth+2), 0xc0)
+	deepCBOR := append(bytes.Repeat([]byte{0x81}, maxDecodeDepth+2), 0xf6)
+
+	tests := []struct {
+		name  string
+		codec Codec
+		data  []byte
+	}{
+		{"msgpack never used code", MsgPackCodec{}, []byte{0xc1}},
+		{"msgpack huge array", MsgPackCodec{}, []byte{0xdd, 0xff, 0xff, 0xff, 0xff}},
+		{"msgpack huge map", MsgPackCodec{}, []byte{0xdf, 0xff, 0xff, 0xff, 0xff}},
+		{"msgpack huge string", MsgPackCodec{}, []byte{0xdb, 0xff, 0xff, 0xff, 0xff, 'a'}},
+		{"msgpack bad timestamp length", MsgPackCodec{}, []byte{0xd5, 0xff, 0, 0}},
+		{"msgpack nested too deeply", MsgPackCodec{}, deepMsgPack},
+		{"cbor reserved additional info", CBORCodec{}, []byte{0x1c}},
+		{"cbor huge array", CBORCodec{}, []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"cbor huge text", CBORCodec{}, []byte{0x7b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"cbor unterminated indefinite array", CBORCodec{}, []byte{0x9f, 0x01}},
+		{"cbor lone break", CBORCodec{}, []byte{0xff}},
+		{"cbor break as map key", CBORCodec{}, []byte{0xa1, 0xff, 0x01}},
+		{"cbor indefinite text with byte chunk", CBORCodec{}, []byte{0x7f, 0x41, 'a', 0xff}},
+		{"cbor time tag on array", CBORCodec{}, []byte{0xc0, 0x80}},
+		{"cbor nested too deeply", CBORCodec{}, deepCBOR},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got any
+			if tt.codec.Unmarshal(tt.data, &got) == nil {
+				t.Errorf("decoding % x succeeded with %v", tt.data, got)
+			}
+		})
+	}
+}
+
+func TestCodecGarbageDoesNotPanic(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for _, codec := range binaryCodecs {
+		valid, err := codec.Marshal(codecKinds{Pointer: &codecNested{Name: "p"}})
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		for i := 0; i < 2000; i++ {
+			mutated := append([]byte{}, valid...)
+			for j := 0; j < 1+random.Intn(4); j++ {
+				mutated[random.Intn(len(mutated))] = byte(random.Intn(256))
+			}
+			// errors are expected; the decoders only must not panic
+			var kinds codecKinds
+			_ = codec.Unmarshal(mutated, &kinds)
+			var generic any
+			_ = codec.Unmarshal(mutated, &generic)
+		}
+	}
+}
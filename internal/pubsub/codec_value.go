@@ -0,0 +1,423 @@
+package pubsub
+
+import (
+	"encoding"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// The MessagePack and CBOR codecs share the mapping between Go values and
+// the data model both formats have in common: nil, booleans, integers,
+// floats, strings, byte strings, arrays, maps and timestamps. Structs are
+// encoded as maps keyed by field name.
+//
+// Encoding walks the Go value and hands each item to a valueWriter. Decoding
+// parses the body into generic values (nil, bool, int64, uint64, float64,
+// string, []byte, time.Time, []any and []mapEntry) that assign then stores
+// into the destination.
+
+type valueWriter interface {
+	writeNil()
+	writeBool(v bool)
+	writeInt(v int64)
+	writeUint(v uint64)
+	writeFloat(v float64)
+	writeString(v string)
+	writeBytes(v []byte)
+	writeTime(v time.Time)
+	writeArrayHeader(n int)
+	writeMapHeader(n int)
+}
+
+type mapEntry struct {
+	key   any
+	value any
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// maxDecodeDepth bounds nesting so that a malicious body cannot exhaust the
+// stack.
+const maxDecodeDepth = 100
+
+func encodeValue(w valueWriter, v reflect.Value) error {
+	if !v.IsValid() {
+		w.writeNil()
+		return nil
+	}
+	if v.Type() == timeType {
+		w.writeTime(v.Interface().(time.Time))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		w.writeBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		w.writeUint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		w.writeFloat(v.Float())
+	case reflect.String:
+		w.writeString(v.String())
+
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		return encodeValue(w, v.Elem())
+
+	case reflect.Slice:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			w.writeBytes(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		w.writeArrayHeader(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			err := encodeValue(w, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		keys := v.MapKeys()
+		sortKeys(keys)
+		w.writeMapHeader(len(keys))
+		for _, key := range keys {
+			err := encodeValue(w, key)
+			if err != nil {
+				return err
+			}
+			err = encodeValue(w, v.MapIndex(key))
+			if err != nil {
+				return err
+			}
+		}
+
+	case reflect.Struct:
+		fields := exportedFields(v.Type())
+		w.writeMapHeader(len(fields))
+		for _, field := range fields {
+			w.writeString(field.Name)
+			err := encodeValue(w, v.FieldByIndex(field.Index))
+			if err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("cannot encode value of type %s", v.Type())
+	}
+	return nil
+}
+
+// sortKeys orders map keys so that equal maps always encode the same way.
+func sortKeys(keys []reflect.Value) {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		switch a.Kind() {
+		case reflect.String:
+			return a.String() < b.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return a.Int() < b.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return a.Uint() < b.Uint()
+		case reflect.Float32, reflect.Float64:
+			return a.Float() < b.Float()
+		default:
+			return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+		}
+	})
+}
+
+func exportedFields(t reflect.Type) []reflect.StructField {
+	fields := []reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.IsExported() {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// unmarshalValue stores a decoded generic value into the value v points to.
+func unmarshalValue(decoded any, v any) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return fmt.Errorf("cannot decode into non-pointer %T", v)
+	}
+	return assign(target.Elem(), decoded)
+}
+
+func assign(dst reflect.Value, src any) error {
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Pointer:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return assign(dst.Elem(), src)
+	case reflect.Interface:
+		if dst.NumMethod() != 0 {
+			return fmt.Errorf("cannot decode into interface %s", dst.Type())
+		}
+		dst.Set(reflect.ValueOf(generic(src)))
+		return nil
+	}
+
+	if dst.Type() == timeType {
+		return assignTime(dst, src)
+	}
+
+	switch dst.Kind() {
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return mismatch(dst, src)
+		}
+		dst.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		switch s := src.(type) {
+		case int64:
+			n = s
+		case uint64:
+			if s > math.MaxInt64 {
+				return overflow(dst, src)
+			}
+			n = int64(s)
+		default:
+			return mismatch(dst, src)
+		}
+		if dst.OverflowInt(n) {
+			return overflow(dst, src)
+		}
+		dst.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var n uint64
+		switch s := src.(type) {
+		case uint64:
+			n = s
+		case int64:
+			if s < 0 {
+				return overflow(dst, src)
+			}
+			n = uint64(s)
+		default:
+			return mismatch(dst, src)
+		}
+		if dst.OverflowUint(n) {
+			return overflow(dst, src)
+		}
+		dst.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		switch s := src.(type) {
+		case float64:
+			dst.SetFloat(s)
+		case int64:
+			dst.SetFloat(float64(s))
+		case uint64:
+			dst.SetFloat(float64(s))
+		default:
+			return mismatch(dst, src)
+		}
+
+	case reflect.String:
+		switch s := src.(type) {
+		case string:
+			dst.SetString(s)
+		case []byte:
+			dst.SetString(string(s))
+		default:
+			return mismatch(dst, src)
+		}
+
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			switch s := src.(type) {
+			case []byte:
+				dst.SetBytes(append([]byte{}, s...))
+				return nil
+			case string:
+				dst.SetBytes([]byte(s))
+				return nil
+			}
+		}
+		items, ok := src.([]any)
+		if !ok {
+			return mismatch(dst, src)
+		}
+		slice := reflect.MakeSlice(dst.Type(), len(items), len(items))
+		for i, item := range items {
+			err := assign(slice.Index(i), item)
+			if err != nil {
+				return err
+			}
+		}
+		dst.Set(slice)
+
+	case reflect.Array:
+		items, ok := src.([]any)
+		if !ok {
+			return mismatch(dst, src)
+		}
+		if len(items) != dst.Len() {
+			return fmt.Errorf("cannot decode array of %d items into %s", len(items), dst.Type())
+		}
+		for i, item := range items {
+			err := assign(dst.Index(i), item)
+			if err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		entries, ok := src.([]mapEntry)
+		if !ok {
+			return mismatch(dst, src)
+		}
+		m := reflect.MakeMapWithSize(dst.Type(), len(entries))
+		for _, entry := range entries {
+			key := reflect.New(dst.Type().Key()).Elem()
+			err := assign(key, entry.key)
+			if err != nil {
+				return err
+			}
+			value := reflect.New(dst.Type().Elem()).Elem()
+			err = assign(value, entry.value)
+			if err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		dst.Set(m)
+
+	case reflect.Struct:
+		entries, ok := src.([]mapEntry)
+		if !ok {
+			return mismatch(dst, src)
+		}
+		for _, entry := range entries {
+			name, ok := entry.key.(string)
+			if !ok {
+				return fmt.Errorf("cannot decode map key %v into a field of %s", entry.key, dst.Type())
+			}
+			field, ok := dst.Type().FieldByName(name)
+			if !ok || !field.IsExported() {
+				// unknown fields are skipped, like encoding/json does
+				continue
+			}
+			err := assign(dst.FieldByIndex(field.Index), entry.value)
+			if err != nil {
+				return fmt.Errorf("%s.%s: %w", dst.Type(), name, err)
+			}
+		}
+
+	default:
+		return fmt.Errorf("cannot decode into value of type %s", dst.Type())
+	}
+	return nil
+}
+
+func assignTime(dst reflect.Value, src any) error {
+	var t time.Time
+	switch s := src.(type) {
+	case time.Time:
+		t = s
+	case int64:
+		t = time.Unix(s, 0)
+	case uint64:
+		if s > math.MaxInt64 {
+			return overflow(dst, src)
+		}
+		t = time.Unix(int64(s), 0)
+	case float64:
+		seconds, fraction := math.Modf(s)
+		t = time.Unix(int64(seconds), int64(fraction*1e9))
+	case string:
+		err := dst.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+		if err != nil {
+			return err
+		}
+		return nil
+	default:
+		return mismatch(dst, src)
+	}
+	dst.Set(reflect.ValueOf(t))
+	return nil
+}
+
+// generic converts a decoded value into the types encoding/json would use
+// for an interface{}: maps become map[string]any, or map[any]any when some
+// keys are not strings.
+func generic(src any) any {
+	switch s := src.(type) {
+	case []any:
+		items := make([]any, len(s))
+		for i, item := range s {
+			items[i] = generic(item)
+		}
+		return items
+	case []mapEntry:
+		stringKeys := true
+		for _, entry := range s {
+			if _, ok := entry.key.(string); !ok {
+				stringKeys = false
+				break
+			}
+		}
+		if stringKeys {
+			m := make(map[string]any, len(s))
+			for _, entry := range s {
+				m[entry.key.(string)] = generic(entry.value)
+			}
+			return m
+		}
+		m := make(map[any]any, len(s))
+		for _, entry := range s {
+			key := entry.key
+			switch k := key.(type) {
+			case []byte:
+				key = string(k)
+			case []any, []mapEntry:
+				key = fmt.Sprint(generic(k))
+			}
+			m[key] = generic(entry.value)
+		}
+		return m
+	default:
+		return src
+	}
+}
+
+func mismatch(dst reflect.Value, src any) error {
+	return fmt.Errorf("cannot decode %T into %s", src, dst.Type())
+}
+
+func overflow(dst reflect.Value, src any) error {
+	return fmt.Errorf("value %v overflows %s", src, dst.Type())
+}
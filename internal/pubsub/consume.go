@@ -1,11 +1,11 @@
 package pubsub
 
 import (
-	"bytes"
-	"encoding/gob"
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
+	"reflect"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/routing"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -15,6 +15,9 @@ type SimpleQueueType int
 const (
 	SimpleQueueDurable SimpleQueueType = iota
 	SimpleQueueTransient
+	// SimpleQueueShared is deleted with its last consumer like a transient
+	// queue, but can be consumed from several connections.
+	SimpleQueueShared
 )
 
 type AckType int
@@ -23,161 +26,127 @@ const (
 	Ack AckType = iota
 	NackRequeue
 	NackDiscard
+	// RetryLater redelivers the message after a backoff, see RetryOptions.
+	RetryLater
 )
 
+func (a AckType) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case NackRequeue:
+		return "nack-requeue"
+	case NackDiscard:
+		return "nack-discard"
+	case RetryLater:
+		return "retry-later"
+	default:
+		return fmt.Sprintf("AckType(%d)", int(a))
+	}
+}
+
 func DeclareAndBind(
-	connection *amqp.Connection,
-	exchange,
-	queueName,
-	key string,
+	broker Broker,
+	exchange string,
+	queueName routing.QueueName,
+	key routing.RoutingKey,
 	simpleQueueType SimpleQueueType, // an enum to represent "durable" or "transient"
-) (*amqp.Channel, amqp.Queue, error) {
-	channel, err := connection.Channel()
+) (Channel, amqp.Queue, error) {
+	return declareAndBind(broker, exchange, string(queueName), string(key), simpleQueueType, nil)
+}
+
+// declareAndBind works like DeclareAndBind, declaring the queue with args on
+// top of the dead-letter exchange.
+func declareAndBind(broker Broker, exchange, queueName, key string, simpleQueueType SimpleQueueType, args amqp.Table) (Channel, amqp.Queue, error) {
+	channel, err := broker.Channel()
 	if err != nil {
 		return nil, amqp.Queue{}, fmt.Errorf("could not open channel: %v", err)
 	}
 
+	queueArgs := amqp.Table{
+		"x-dead-letter-exchange": routing.ExchangePerilDLX,
+	}
+	for k, v := range args {
+		queueArgs[k] = v
+	}
 	queue, err := channel.QueueDeclare(
 		queueName,
 		simpleQueueType == SimpleQueueDurable,
 		simpleQueueType != SimpleQueueDurable,
-		simpleQueueType != SimpleQueueDurable,
+		simpleQueueType == SimpleQueueTransient,
 		false,
-		amqp.Table{
-			"x-dead-letter-exchange": "peril_dlx",
-		},
+		queueArgs,
 	)
 	if err != nil {
 		return nil, amqp.Queue{}, fmt.Errorf("could not declare queue: %v", err)
 	}
 
-	channel.QueueBind(
+	err = channel.QueueBind(
 		queue.Name,
 		key,
 		exchange,
 		false,
 		nil,
 	)
-
-	return channel, queue, nil
-}
-
-func SubscribeJSON[T any](
-	connection *amqp.Connection,
-	exchange,
-	queueName,
-	key string,
-	simpleQueueType SimpleQueueType,
-	handler func(T) AckType,
-) error {
-	JSONunmarshaller := func(data []byte) (T, error) {
-		var msg T
-		err := json.Unmarshal(data, &msg)
-		if err != nil {
-			return msg, fmt.Errorf("could not unmarshal JSON message: %v", err)
-		}
-		return msg, nil
+	if err != nil {
+		return nil, amqp.Queue{}, fmt.Errorf("could not bind queue: %v", err)
 	}
 
-	return subscribe(
-		connection,
-		exchange,
-		queueName,
-		key,
-		simpleQueueType,
-		handler,
-		JSONunmarshaller,
-	)
+	return channel, queue, nil
 }
 
-func SubscribeGob[T any](
-	connection *amqp.Connection,
-	exchange,
-	queueName,
-	key string,
+// Subscribe consumes the queue and passes every decoded message to handler.
+// Deliveries are decoded with the codec registered for their content type.
+func Subscribe[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange string,
+	queueName routing.QueueName,
+	key routing.RoutingKey,
 	simpleQueueType SimpleQueueType,
 	handler func(T) AckType,
-) error {
-	GOBdecoder := func(data []byte) (T, error) {
-		var msg T
-		decoder := gob.NewDecoder(bytes.NewReader(data))
-		err := decoder.Decode(&msg)
-		if err != nil {
-			return msg, fmt.Errorf("could not decode GOB message: %v", err)
-		}
-		return msg, nil
-	}
-
-	return subscribe(
-		connection,
+	options ...SubscribeOption,
+) (*Subscription, error) {
+	return SubscribeEnvelope(
+		ctx,
+		broker,
 		exchange,
 		queueName,
 		key,
 		simpleQueueType,
-		handler,
-		GOBdecoder,
+		func(envelope Envelope[T]) AckType {
+			return handler(envelope.Payload)
+		},
+		options...,
 	)
 }
 
-func subscribe[T any](
-	connection *amqp.Connection,
-	exchange,
-	queueName,
-	key string,
+// SubscribeEnvelope works like Subscribe, but passes the handler the message
+// metadata and headers along with the decoded payload.
+func SubscribeEnvelope[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange string,
+	queueName routing.QueueName,
+	key routing.RoutingKey,
 	simpleQueueType SimpleQueueType,
-	handler func(T) AckType,
-	unmarshaller func([]byte) (T, error),
-) error {
-	channel, _, err := DeclareAndBind(
-		connection,
-		exchange,
-		queueName,
-		key,
-		simpleQueueType,
-	)
-	if err != nil {
-		return fmt.Errorf("could not declare and bind queue: %v", err)
+	handler func(Envelope[T]) AckType,
+	options ...SubscribeOption,
+) (*Subscription, error) {
+	sub := newSubscription(exchange, string(queueName), string(key), simpleQueueType, options)
+	if sub.options.orderType != nil && sub.options.orderType != reflect.TypeFor[T]() {
+		return nil, fmt.Errorf("ordering key takes %s, but messages are %s", sub.options.orderType, reflect.TypeFor[T]())
 	}
-
-	err = channel.Qos(10, 0, false)
-	if err != nil {
-		return fmt.Errorf("could not set QoS: %v", err)
+	sub.unmarshal = func(delivery amqp.Delivery) (any, error) {
+		return decodeSchema[T](delivery, sub.decode)
 	}
+	sub.handle = chain(func(message *Message) AckType {
+		return handler(newEnvelope(message.Payload.(T), message.delivery))
+	}, sub.options.middleware)
 
-	consume_channel, err := channel.Consume(
-		queueName,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
+	err := sub.start(ctx, broker)
 	if err != nil {
-		return fmt.Errorf("could not consume queue: %v", err)
+		return nil, err
 	}
-
-	go func() {
-		defer channel.Close()
-		for delivery := range consume_channel {
-			msg, err := unmarshaller(delivery.Body)
-			if err != nil {
-				log.Print(err)
-				continue
-			}
-			ack := handler(msg)
-			switch ack {
-			case Ack:
-				delivery.Ack(false)
-
-			case NackRequeue:
-				delivery.Nack(false, true)
-
-			case NackDiscard:
-				delivery.Nack(false, false)
-			}
-		}
-	}()
-
-	return nil
+	return sub, nil
 }
@@ -0,0 +1,201 @@
+package pubsub
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DedupStore records the IDs of processed messages. Implementations must be
+// safe for concurrent use.
+type DedupStore interface {
+	// Seen reports whether id was marked and has not expired yet.
+	Seen(id string) (bool, error)
+	Mark(id string) error
+}
+
+// DedupStats counts the messages a Deduplicator checked. Hits are the
+// duplicates it skipped.
+type DedupStats struct {
+	Hits   int64
+	Misses int64
+}
+
+// Deduplicator makes a subscription idempotent: a message whose ID was
+// already handled with Ack is acked again without calling the handler.
+// Messages without a message ID are always handled. IDs are scoped to the
+// queue, so one store can be shared by several subscriptions.
+type Deduplicator struct {
+	store  DedupStore
+	hits   atomic.Int64
+	misses atomic.Int64
+
+	mu       sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+func NewDeduplicator(store DedupStore) *Deduplicator {
+	return &Deduplicator{
+		store:    store,
+		inflight: map[string]chan struct{}{},
+	}
+}
+
+// Middleware is the Middleware skipping duplicates, for use with
+// WithMiddleware. A duplicate that arrives while the first copy is still
+// being handled waits for it, so both are never handled at the same time.
+func (d *Deduplicator) Middleware(next Handler) Handler {
+	return func(message *Message) AckType {
+		if message.MessageID == "" {
+			return next(message)
+		}
+		id := message.Queue + "/" + message.MessageID
+
+		release := d.begin(id)
+		defer release()
+
+		seen, err := d.store.Seen(id)
+		if err != nil {
+			// handling twice is better than not at all
+			log.Printf("could not check message %s for duplicates: %v", message.MessageID, err)
+		}
+		if seen {
+			d.hits.Add(1)
+			return Ack
+		}
+		d.misses.Add(1)
+
+		ack := next(message)
+		if ack == Ack {
+			err := d.store.Mark(id)
+			if err != nil {
+				log.Printf("could not mark message %s as processed: %v", message.MessageID, err)
+			}
+		}
+		return ack
+	}
+}
+
+// begin waits until no other copy of the message is in flight and claims
+// it.
+func (d *Deduplicator) begin(id string) (release func()) {
+	d.mu.Lock()
+	for {
+		done, ok := d.inflight[id]
+		if !ok {
+			break
+		}
+		d.mu.Unlock()
+		<-done
+		d.mu.Lock()
+	}
+	done := make(chan struct{})
+	d.inflight[id] = done
+	d.mu.Unlock()
+
+	return func() {
+		d.mu.Lock()
+		delete(d.inflight, id)
+		d.mu.Unlock()
+		close(done)
+	}
+}
+
+func (d *Deduplicator) Stats() DedupStats {
+	return DedupStats{Hits: d.hits.Load(), Misses: d.misses.Load()}
+}
+
+// MemoryDedupStore keeps up to capacity IDs for ttl each, forgetting the
+// least recently marked ones first.
+type MemoryDedupStore struct {
+	capacity int
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type dedupEntry struct {
+	id      string
+	expires time.Time
+}
+
+func NewMemoryDedupStore(capacity int, ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		capacity: max(capacity, 1),
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryDedupStore) Seen(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.entries[id]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(element.Value.(*dedupEntry).expires) {
+		s.remove(element)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *MemoryDedupStore) Mark(id string) error {
+	s.add(id, time.Now().Add(s.ttl))
+	return nil
+}
+
+func (s *MemoryDedupStore) add(id string, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, ok := s.entries[id]; ok {
+		element.Value.(*dedupEntry).expires = expires
+		s.order.MoveToFront(element)
+	} else {
+		s.entries[id] = s.order.PushFront(&dedupEntry{id: id, expires: expires})
+	}
+
+	now := time.Now()
+	for s.order.Len() > 0 {
+		oldest := s.order.Back()
+		if s.order.Len() <= s.capacity && now.Before(oldest.Value.(*dedupEntry).expires) {
+			break
+		}
+		s.remove(oldest)
+	}
+}
+
+func (s *MemoryDedupStore) remove(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.entries, element.Value.(*dedupEntry).id)
+}
+
+func (s *MemoryDedupStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+// live returns the entries that have not expired, oldest first.
+func (s *MemoryDedupStore) live() []dedupEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	live := make([]dedupEntry, 0, s.order.Len())
+	for element := s.order.Back(); element != nil; element = element.Prev() {
+		entry := element.Value.(*dedupEntry)
+		if now.Before(entry.expires) {
+			live = append(live, *entry)
+		}
+	}
+	return live
+}
@@ -0,0 +1,134 @@
+package pubsub
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/atomicfile"
+)
+
+// FileDedupStore is a MemoryDedupStore that survives restarts. Every marked
+// ID is appended to a file, which is read back on open and rewritten with
+// only the live IDs once it has grown to twice the capacity. Writes are not
+// synced, so IDs marked just before a power loss may be forgotten.
+type FileDedupStore struct {
+	*MemoryDedupStore
+	path string
+
+	mu    sync.Mutex
+	file  *os.File
+	lines int
+}
+
+func OpenFileDedupStore(path string, capacity int, ttl time.Duration) (*FileDedupStore, error) {
+	s := &FileDedupStore{
+		MemoryDedupStore: NewMemoryDedupStore(capacity, ttl),
+		path:             path,
+	}
+
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	err = s.compact()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the file, one "<expiry in unix nanoseconds> <id>" line per
+// marked ID.
+func (s *FileDedupStore) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not open dedup store: %v", err)
+	}
+	defer file.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		expiry, id, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			// a line cut short by a crash
+			continue
+		}
+		nanoseconds, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil {
+			continue
+		}
+		expires := time.Unix(0, nanoseconds)
+		if expires.After(now) {
+			s.add(id, expires)
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("could not read dedup store: %v", err)
+	}
+	return nil
+}
+
+func (s *FileDedupStore) Mark(id string) error {
+	expires := time.Now().Add(s.ttl)
+	s.add(id, expires)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	_, err := fmt.Fprintf(s.file, "%d %s\n", expires.UnixNano(), id)
+	if err != nil {
+		return fmt.Errorf("could not write dedup store: %v", err)
+	}
+	s.lines++
+	if s.lines >= 2*s.capacity {
+		return s.compactLocked()
+	}
+	return nil
+}
+
+func (s *FileDedupStore) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compactLocked()
+}
+
+// compactLocked replaces the file with one holding only the live IDs and
+// reopens it for appending.
+func (s *FileDedupStore) compactLocked() error {
+	live := s.live()
+	var err error
+	s.file, err = atomicfile.Rewrite(s.path, s.file, func(w *bufio.Writer) error {
+		for _, entry := range live {
+			fmt.Fprintf(w, "%d %s\n", entry.expires.UnixNano(), entry.id)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not compact dedup store: %v", err)
+	}
+	s.lines = len(live)
+	return nil
+}
+
+func (s *FileDedupStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,145 @@
+package pubsub
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assertSeen(t *testing.T, store DedupStore, id string, want bool) {
+	t.Helper()
+	seen, err := store.Seen(id)
+	if err != nil {
+		t.Fatalf("Seen(%q): %v", id, err)
+	}
+	if seen != want {
+		t.Errorf("Seen(%q) = %v, want %v", id, seen, want)
+	}
+}
+
+func TestMemoryDedupStoreEvictsLeastRecentlyMarked(t *testing.T) {
+	store := NewMemoryDedupStore(2, time.Hour)
+	store.Mark("a")
+	store.Mark("b")
+	// marking a again makes b the least recently marked
+	store.Mark("a")
+	store.Mark("c")
+
+	assertSeen(t, store, "a", true)
+	assertSeen(t, store, "b", false)
+	assertSeen(t, store, "c", true)
+	if store.Len() != 2 {
+		t.Errorf("store holds %d IDs, want its capacity of 2", store.Len())
+	}
+}
+
+func TestMemoryDedupStoreExpires(t *testing.T) {
+	store := NewMemoryDedupStore(10, 20*time.Millisecond)
+	store.Mark("a")
+	assertSeen(t, store, "a", true)
+
+	time.Sleep(40 * time.Millisecond)
+	assertSeen(t, store, "a", false)
+	// expired IDs are dropped when others are marked
+	store.Mark("b")
+	if store.Len() != 1 {
+		t.Errorf("store holds %d IDs, want only the live one", store.Len())
+	}
+}
+
+func TestFileDedupStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	store, err := OpenFileDedupStore(path, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("could not open: %v", err)
+	}
+	store.Mark("a")
+	store.Mark("b")
+	store.Close()
+
+	// an expired ID and a line torn by a crash are skipped on load
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(file, "%d expired\n%d", time.Now().Add(-time.Second).UnixNano(), time.Now().Add(time.Hour).UnixNano())
+	file.Close()
+
+	store, err = OpenFileDedupStore(path, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("could not reopen: %v", err)
+	}
+	defer store.Close()
+	assertSeen(t, store, "a", true)
+	assertSeen(t, store, "b", true)
+	assertSeen(t, store, "expired", false)
+	if store.Len() != 2 {
+		t.Errorf("reloaded %d IDs, want 2", store.Len())
+	}
+
+	store.Mark("c")
+	assertSeen(t, store, "c", true)
+}
+
+func TestFileDedupStoreCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	store, err := OpenFileDedupStore(path, 3, time.Hour)
+	if err != nil {
+		t.Fatalf("could not open: %v", err)
+	}
+	defer store.Close()
+
+	for i := 1; i <= 5; i++ {
+		store.Mark(fmt.Sprint(i))
+	}
+	data, _ := os.ReadFile(path)
+	if n := strings.Count(string(data), "\n"); n != 5 {
+		t.Fatalf("file has %d lines before compaction, want 5", n)
+	}
+
+	// the sixth line reaches twice the capacity
+	store.Mark("6")
+	data, _ = os.ReadFile(path)
+	if got := strings.Count(string(data), "\n"); got != 3 {
+		t.Errorf("file has %d lines after compaction, want the 3 live IDs", got)
+	}
+	for _, id := range []string{"4", "5", "6"} {
+		if !strings.Contains(string(data), " "+id+"\n") {
+			t.Errorf("compacted file lacks %s:\n%s", id, data)
+		}
+	}
+
+	// the compacted file is appended to
+	store.Mark("7")
+	data, _ = os.ReadFile(path)
+	if !strings.HasSuffix(string(data), " 7\n") {
+		t.Errorf("mark after compaction was not appended:\n%s", data)
+	}
+}
+
+func TestDeduplicatorSkipsHandledMessages(t *testing.T) {
+	deduplicator := NewDeduplicator(NewMemoryDedupStore(10, time.Hour))
+	calls := 0
+	result := RetryLater
+	handler := deduplicator.Middleware(func(*Message) AckType {
+		calls++
+		return result
+	})
+
+	// a message that was not acked is handled again
+	handler(newTestMessage())
+	result = Ack
+	handler(newTestMessage())
+	if ack := handler(newTestMessage()); ack != Ack {
+		t.Errorf("duplicate settled with %v, want %v", ack, Ack)
+	}
+	if calls != 2 {
+		t.Errorf("handler ran %d times, want 2", calls)
+	}
+	if stats := deduplicator.Stats(); stats != (DedupStats{Hits: 1, Misses: 2}) {
+		t.Errorf("got %+v, want 1 hit and 2 misses", stats)
+	}
+}
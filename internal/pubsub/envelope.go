@@ -0,0 +1,77 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Envelope is a decoded message together with the metadata it was delivered
+// with.
+type Envelope[T any] struct {
+	Payload       T
+	MessageID     string
+	CorrelationID string
+	Timestamp     time.Time
+	AppID         string
+	ContentType   string
+	Exchange      string
+	RoutingKey    string
+	ReplyTo       string
+	Redelivered   bool
+	Headers       amqp.Table
+}
+
+// newEnvelope reports the exchange and routing key the message was
+// originally published with, also for retried and requeued messages that
+// reach the queue again through the default exchange.
+func newEnvelope[T any](payload T, delivery amqp.Delivery) Envelope[T] {
+	exchange, key := originalRoute(delivery)
+	return Envelope[T]{
+		Payload:       payload,
+		MessageID:     delivery.MessageId,
+		CorrelationID: delivery.CorrelationId,
+		Timestamp:     delivery.Timestamp,
+		AppID:         delivery.AppId,
+		ContentType:   delivery.ContentType,
+		Exchange:      exchange,
+		RoutingKey:    key,
+		ReplyTo:       delivery.ReplyTo,
+		Redelivered:   delivery.Redelivered,
+		Headers:       delivery.Headers,
+	}
+}
+
+func originalRoute(delivery amqp.Delivery) (exchange, key string) {
+	exchange, ok := delivery.Headers["x-original-exchange"].(string)
+	if !ok {
+		return delivery.Exchange, delivery.RoutingKey
+	}
+	key, _ = delivery.Headers["x-original-routing-key"].(string)
+	return exchange, key
+}
+
+// Correlate returns a context that makes messages published with it carry
+// the correlation ID of this message. A message without one starts a new
+// chain identified by its own message ID.
+func (e Envelope[T]) Correlate(ctx context.Context) context.Context {
+	id := e.CorrelationID
+	if id == "" {
+		id = e.MessageID
+	}
+	return ContextWithCorrelationID(ctx, id)
+}
+
+type correlationKey struct{}
+
+// ContextWithCorrelationID returns a context whose correlation ID is set on
+// every message published with it, unless the message already has one.
+func ContextWithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+func CorrelationIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
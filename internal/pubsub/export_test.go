@@ -0,0 +1,9 @@
+package pubsub
+
+import amqp "github.com/rabbitmq/amqp091-go"
+
+// DecodeSchema decodes a delivery by its content type the way subscriptions
+// do, for the tests of the schemas package outside pubsub.
+func DecodeSchema[T any](delivery amqp.Delivery) (T, error) {
+	return decodeSchema[T](delivery, decodeReply)
+}
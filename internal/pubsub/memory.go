@@ -0,0 +1,1179 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/routing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MemoryBroker is an in-process broker with the routing, acknowledgement and
+// dead-lettering semantics of RabbitMQ that this repo relies on. Connect
+// returns a Broker backed by it.
+type MemoryBroker struct {
+	mu          sync.Mutex
+	exchanges   map[string]*memoryExchange
+	queues      map[string]*memoryQueue
+	connections map[*memoryConnection]struct{}
+	nextID      int
+}
+
+type memoryExchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	internal   bool
+	args       amqp.Table
+	bindings   []memoryBinding
+}
+
+type memoryBinding struct {
+	queue string
+	key   string
+}
+
+type memoryQueue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	owner      *memoryConnection
+	args       amqp.Table
+	messages   []*memoryMessage
+	consumers  []*memoryConsumer
+	next       int
+	consumed   bool
+	deleted    bool
+}
+
+type memoryMessage struct {
+	exchange    string
+	routingKey  string
+	publishing  amqp.Publishing
+	redelivered bool
+	expires     time.Time
+}
+
+type memoryConnection struct {
+	broker      *MemoryBroker
+	channels    map[*memoryChannel]struct{}
+	notifyClose []chan *amqp.Error
+	closed      bool
+}
+
+type memoryChannel struct {
+	connection    *memoryConnection
+	prefetch      int
+	consumers     map[string]*memoryConsumer
+	unacked       map[uint64]*memoryUnacked
+	deliveryTag   uint64
+	confirming    bool
+	publishSeq    uint64
+	events        *memoryEvents
+	notifyClose   []chan *amqp.Error
+	notifyPublish []chan amqp.Confirmation
+	notifyReturn  []chan amqp.Return
+	closed        bool
+}
+
+// memoryEvents runs channel notifications in order on their own goroutine,
+// so listeners see returns before confirms and slow listeners cannot block
+// the broker.
+type memoryEvents struct {
+	mu      sync.Mutex
+	pending []func()
+	wake    chan struct{}
+}
+
+type memoryUnacked struct {
+	message  *memoryMessage
+	queue    *memoryQueue
+	consumer *memoryConsumer
+}
+
+type memoryConsumer struct {
+	tag        string
+	channel    *memoryChannel
+	queue      *memoryQueue
+	autoAck    bool
+	exclusive  bool
+	unacked    int
+	buffer     []amqp.Delivery
+	ready      *sync.Cond
+	deliveries chan amqp.Delivery
+	done       chan struct{}
+	cancelled  bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		exchanges:   map[string]*memoryExchange{},
+		queues:      map[string]*memoryQueue{},
+		connections: map[*memoryConnection]struct{}{},
+	}
+	for name, kind := range map[string]string{
+		"":           amqp.ExchangeDirect,
+		"amq.direct": amqp.ExchangeDirect,
+		"amq.fanout": amqp.ExchangeFanout,
+		"amq.topic":  amqp.ExchangeTopic,
+	} {
+		b.exchanges[name] = &memoryExchange{name: name, kind: kind, durable: true}
+	}
+	return b
+}
+
+func (b *MemoryBroker) Connect() (Broker, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	connection := &memoryConnection{
+		broker:   b,
+		channels: map[*memoryChannel]struct{}{},
+	}
+	b.connections[connection] = struct{}{}
+	return connection, nil
+}
+
+// Restart simulates a broker restart: every connection is closed with
+// CONNECTION_FORCED, transient exchanges and queues are dropped and only
+// persistent messages survive in durable queues.
+func (b *MemoryBroker) Restart() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for connection := range b.connections {
+		connection.shutdown(&amqp.Error{
+			Code:   amqp.ConnectionForced,
+			Reason: "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'",
+			Server: true,
+		})
+	}
+
+	for _, queue := range b.queues {
+		if !queue.durable {
+			b.deleteQueue(queue)
+			continue
+		}
+		kept := queue.messages[:0]
+		for _, message := range queue.messages {
+			if message.publishing.DeliveryMode == amqp.Persistent {
+				kept = append(kept, message)
+			}
+		}
+		queue.messages = kept
+	}
+	for name, exchange := range b.exchanges {
+		if !exchange.durable {
+			delete(b.exchanges, name)
+		}
+	}
+}
+
+func (b *MemoryBroker) generateName(prefix string) string {
+	b.nextID++
+	return fmt.Sprintf("%s-%d", prefix, b.nextID)
+}
+
+func (b *MemoryBroker) deleteQueue(queue *memoryQueue) {
+	if queue.deleted {
+		return
+	}
+	queue.deleted = true
+	queue.messages = nil
+	for _, consumer := range queue.consumers {
+		consumer.cancel()
+		delete(consumer.channel.consumers, consumer.tag)
+	}
+	queue.consumers = nil
+	delete(b.queues, queue.name)
+	for _, exchange := range b.exchanges {
+		bindings := exchange.bindings[:0]
+		for _, binding := range exchange.bindings {
+			if binding.queue != queue.name {
+				bindings = append(bindings, binding)
+			}
+		}
+		exchange.bindings = bindings
+	}
+}
+
+func (b *MemoryBroker) route(exchangeName, key string, publishing amqp.Publishing) (int, error) {
+	if exchangeName == "" {
+		queue, ok := b.queues[key]
+		if !ok {
+			return 0, nil
+		}
+		b.enqueue(queue, &memoryMessage{exchange: exchangeName, routingKey: key, publishing: publishing})
+		return 1, nil
+	}
+
+	exchange, ok := b.exchanges[exchangeName]
+	if !ok {
+		return 0, &amqp.Error{
+			Code:   amqp.NotFound,
+			Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '/'", exchangeName),
+			Server: true,
+		}
+	}
+
+	routed := map[string]bool{}
+	for _, binding := range exchange.bindings {
+		if routed[binding.queue] || !exchange.matches(binding.key, key) {
+			continue
+		}
+		routed[binding.queue] = true
+		b.enqueue(b.queues[binding.queue], &memoryMessage{exchange: exchangeName, routingKey: key, publishing: publishing})
+	}
+	return len(routed), nil
+}
+
+func (e *memoryExchange) matches(bindingKey, key string) bool {
+	switch e.kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return routing.MatchTopic(bindingKey, key)
+	default:
+		return bindingKey == key
+	}
+}
+
+func (b *MemoryBroker) enqueue(queue *memoryQueue, message *memoryMessage) {
+	if ttl, ok := messageTTL(queue, message.publishing); ok {
+		message.expires = time.Now().Add(ttl)
+		time.AfterFunc(ttl, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.dispatch(queue)
+		})
+	}
+	queue.messages = append(queue.messages, message)
+	b.dispatch(queue)
+}
+
+// messageTTL is the lower of the queue's x-message-ttl and the message's
+// expiration, both in milliseconds.
+func messageTTL(queue *memoryQueue, publishing amqp.Publishing) (time.Duration, bool) {
+	ttl, ok := time.Duration(0), false
+	if _, set := queue.args["x-message-ttl"]; set {
+		ttl, ok = time.Duration(headerInt(queue.args, "x-message-ttl"))*time.Millisecond, true
+	}
+	if publishing.Expiration != "" {
+		expiration, err := strconv.ParseInt(publishing.Expiration, 10, 64)
+		if err == nil && (!ok || time.Duration(expiration)*time.Millisecond < ttl) {
+			ttl, ok = time.Duration(expiration)*time.Millisecond, true
+		}
+	}
+	return ttl, ok
+}
+
+// expire dead-letters expired messages at the head of the queue. Like
+// RabbitMQ, it leaves expired messages behind the head until they get there.
+func (b *MemoryBroker) expire(queue *memoryQueue) {
+	if queue.deleted {
+		return
+	}
+	now := time.Now()
+	for len(queue.messages) > 0 {
+		message := queue.messages[0]
+		if message.expires.IsZero() || message.expires.After(now) {
+			return
+		}
+		queue.messages = queue.messages[1:]
+		b.deadLetter(queue, message, "expired")
+	}
+}
+
+func (b *MemoryBroker) requeue(queue *memoryQueue, message *memoryMessage) {
+	if queue.deleted {
+		return
+	}
+	message.redelivered = true
+	queue.messages = append([]*memoryMessage{message}, queue.messages...)
+}
+
+func (b *MemoryBroker) dispatch(queue *memoryQueue) {
+	b.expire(queue)
+	for len(queue.messages) > 0 {
+		consumer := queue.nextConsumer()
+		if consumer == nil {
+			return
+		}
+		message := queue.messages[0]
+		queue.messages = queue.messages[1:]
+		consumer.deliver(message)
+	}
+}
+
+func (b *MemoryBroker) deadLetter(queue *memoryQueue, message *memoryMessage, reason string) {
+	exchange, ok := queue.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := message.routingKey
+	if k, ok := queue.args["x-dead-letter-routing-key"].(string); ok {
+		key = k
+	}
+
+	publishing := message.publishing
+	publishing.Headers = amqp.Table{}
+	for k, v := range message.publishing.Headers {
+		publishing.Headers[k] = v
+	}
+
+	death := amqp.Table{
+		"reason":       reason,
+		"queue":        queue.name,
+		"time":         time.Now(),
+		"exchange":     message.exchange,
+		"routing-keys": []interface{}{message.routingKey},
+	}
+	if publishing.Expiration != "" {
+		// the expiration is dropped so the message does not expire again
+		death["original-expiration"] = publishing.Expiration
+		publishing.Expiration = ""
+	}
+
+	deaths, _ := publishing.Headers["x-death"].([]interface{})
+	count := int64(1)
+	updated := []interface{}{}
+	for _, d := range deaths {
+		death, ok := d.(amqp.Table)
+		if ok && death["queue"] == queue.name && death["reason"] == reason {
+			count, _ = death["count"].(int64)
+			count++
+			continue
+		}
+		updated = append(updated, d)
+	}
+	death["count"] = count
+	publishing.Headers["x-death"] = append([]interface{}{death}, updated...)
+	if _, ok := publishing.Headers["x-first-death-queue"]; !ok {
+		publishing.Headers["x-first-death-queue"] = queue.name
+		publishing.Headers["x-first-death-reason"] = reason
+		publishing.Headers["x-first-death-exchange"] = message.exchange
+	}
+
+	b.route(exchange, key, publishing)
+}
+
+// nextConsumer picks consumers round-robin, skipping those at their
+// prefetch limit. With x-single-active-consumer only the first one is picked.
+func (q *memoryQueue) nextConsumer() *memoryConsumer {
+	consumers := q.consumers
+	if singleActive, _ := q.args["x-single-active-consumer"].(bool); singleActive && len(consumers) > 1 {
+		consumers = consumers[:1]
+	}
+	for i := range consumers {
+		index := (q.next + i) % len(consumers)
+		consumer := consumers[index]
+		if consumer.autoAck || consumer.channel.prefetch == 0 || consumer.unacked < consumer.channel.prefetch {
+			q.next = (index + 1) % len(consumers)
+			return consumer
+		}
+	}
+	return nil
+}
+
+func (q *memoryQueue) removeConsumer(consumer *memoryConsumer) {
+	for i, c := range q.consumers {
+		if c == consumer {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	if len(q.consumers) > 0 {
+		q.next %= len(q.consumers)
+	} else {
+		q.next = 0
+	}
+}
+
+func (q *memoryQueue) equivalent(durable, autoDelete, exclusive bool, args amqp.Table) bool {
+	return q.durable == durable && q.autoDelete == autoDelete && q.exclusive == exclusive && equivalentArgs(q.args, args)
+}
+
+func equivalentArgs(a, b amqp.Table) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func (c *memoryConnection) BindingExists(binding BindingSpec) (bool, error) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	exchange, ok := b.exchanges[binding.Exchange]
+	if !ok {
+		return false, nil
+	}
+	for _, existing := range exchange.bindings {
+		if existing.queue == string(binding.Queue) && existing.key == string(binding.Key) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *memoryConnection) Channel() (Channel, error) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	channel := &memoryChannel{
+		connection: c,
+		consumers:  map[string]*memoryConsumer{},
+		unacked:    map[uint64]*memoryUnacked{},
+		events:     newMemoryEvents(),
+	}
+	c.channels[channel] = struct{}{}
+	return channel, nil
+}
+
+func (c *memoryConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.notifyClose = append(c.notifyClose, receiver)
+	return receiver
+}
+
+func (c *memoryConnection) Close() error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.shutdown(nil)
+	return nil
+}
+
+func (c *memoryConnection) shutdown(err *amqp.Error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for channel := range c.channels {
+		channel.shutdown(err)
+	}
+	b := c.broker
+	for _, queue := range b.queues {
+		if queue.exclusive && queue.owner == c {
+			b.deleteQueue(queue)
+		}
+	}
+	delete(b.connections, c)
+	notify(c.notifyClose, err)
+	c.notifyClose = nil
+}
+
+// notify mirrors amqp091: listeners receive the error, if any, and are then
+// closed. Sends happen off the broker lock so slow listeners cannot block it.
+func notify(listeners []chan *amqp.Error, err *amqp.Error) {
+	for _, listener := range listeners {
+		go func(listener chan *amqp.Error) {
+			if err != nil {
+				listener <- err
+			}
+			close(listener)
+		}(listener)
+	}
+}
+
+func (ch *memoryChannel) broker() *MemoryBroker {
+	return ch.connection.broker
+}
+
+func (ch *memoryChannel) fail(code int, format string, args ...interface{}) error {
+	err := &amqp.Error{Code: code, Reason: fmt.Sprintf(format, args...), Server: true}
+	ch.shutdown(err)
+	return err
+}
+
+func (ch *memoryChannel) shutdown(err *amqp.Error) {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	b := ch.broker()
+
+	affected := map[*memoryQueue]struct{}{}
+	for tag, consumer := range ch.consumers {
+		consumer.cancel()
+		consumer.queue.removeConsumer(consumer)
+		delete(ch.consumers, tag)
+		affected[consumer.queue] = struct{}{}
+	}
+
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, tag := range tags {
+		unacked := ch.unacked[tag]
+		delete(ch.unacked, tag)
+		b.requeue(unacked.queue, unacked.message)
+		affected[unacked.queue] = struct{}{}
+	}
+	for queue := range affected {
+		ch.releaseQueue(queue)
+	}
+
+	delete(ch.connection.channels, ch)
+	closers, confirms, returns := ch.notifyClose, ch.notifyPublish, ch.notifyReturn
+	ch.notifyClose, ch.notifyPublish, ch.notifyReturn = nil, nil, nil
+	ch.events.push(func() {
+		for _, listener := range closers {
+			if err != nil {
+				listener <- err
+			}
+			close(listener)
+		}
+		for _, listener := range confirms {
+			close(listener)
+		}
+		for _, listener := range returns {
+			close(listener)
+		}
+	})
+	ch.events.push(nil)
+}
+
+// releaseQueue deletes auto-delete queues that lost their last consumer and
+// hands remaining messages to other consumers.
+func (ch *memoryChannel) releaseQueue(queue *memoryQueue) {
+	if queue.deleted {
+		return
+	}
+	b := ch.broker()
+	if queue.autoDelete && len(queue.consumers) == 0 && queue.consumed {
+		b.deleteQueue(queue)
+		return
+	}
+	b.dispatch(queue)
+}
+
+func (ch *memoryChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if existing, ok := b.exchanges[name]; ok {
+		if existing.kind != kind || existing.durable != durable || existing.autoDelete != autoDelete || existing.internal != internal || !equivalentArgs(existing.args, args) {
+			return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg for exchange '%s' in vhost '/'", name)
+		}
+		return nil
+	}
+	if name == "" || strings.HasPrefix(name, "amq.") {
+		return ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - exchange name '%s' contains reserved prefix 'amq.*'", name)
+	}
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic:
+	default:
+		return ch.fail(amqp.CommandInvalid, "COMMAND_INVALID - unknown exchange type '%s'", kind)
+	}
+
+	b.exchanges[name] = &memoryExchange{
+		name:       name,
+		kind:       kind,
+		durable:    durable,
+		autoDelete: autoDelete,
+		internal:   internal,
+		args:       args,
+	}
+	return nil
+}
+
+func (ch *memoryChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		name = b.generateName("amq.gen")
+	}
+	if existing, ok := b.queues[name]; ok {
+		if existing.exclusive && existing.owner != ch.connection {
+			return amqp.Queue{}, ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s' in vhost '/'", name)
+		}
+		if !existing.equivalent(durable, autoDelete, exclusive, args) {
+			return amqp.Queue{}, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg for queue '%s' in vhost '/'", name)
+		}
+		return amqp.Queue{Name: name, Messages: len(existing.messages), Consumers: len(existing.consumers)}, nil
+	}
+
+	queue := &memoryQueue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+	}
+	if exclusive {
+		queue.owner = ch.connection
+	}
+	b.queues[name] = queue
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *memoryChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.exchanges[name]; !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", name)
+	}
+	return nil
+}
+
+func (ch *memoryChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	queue, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", name)
+	}
+	if queue.exclusive && queue.owner != ch.connection {
+		return amqp.Queue{}, ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s' in vhost '/'", name)
+	}
+	return amqp.Queue{Name: name, Messages: len(queue.messages), Consumers: len(queue.consumers)}, nil
+}
+
+func (ch *memoryChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.queues[name]; !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", name)
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", exchange)
+	}
+	if exchange == "" {
+		return ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - operation not permitted on the default exchange")
+	}
+	for _, binding := range ex.bindings {
+		if binding.queue == name && binding.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memoryBinding{queue: name, key: key})
+	return nil
+}
+
+func (ch *memoryChannel) QueueUnbind(name, key, exchange string, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.queues[name]; !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", name)
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", exchange)
+	}
+	bindings := ex.bindings[:0]
+	for _, binding := range ex.bindings {
+		if binding.queue != name || binding.key != key {
+			bindings = append(bindings, binding)
+		}
+	}
+	ex.bindings = bindings
+	return nil
+}
+
+func (ch *memoryChannel) QueuePurge(name string, noWait bool) (int, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+	queue, ok := b.queues[name]
+	if !ok {
+		return 0, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", name)
+	}
+	purged := len(queue.messages)
+	queue.messages = nil
+	return purged, nil
+}
+
+func (ch *memoryChannel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+	queue, ok := b.queues[name]
+	if !ok {
+		// like RabbitMQ, deleting a queue that does not exist succeeds
+		return 0, nil
+	}
+	if queue.exclusive && queue.owner != ch.connection {
+		return 0, ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s' in vhost '/'", name)
+	}
+	if ifUnused && len(queue.consumers) > 0 {
+		return 0, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - queue '%s' in vhost '/' in use", name)
+	}
+	if ifEmpty && len(queue.messages) > 0 {
+		return 0, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - queue '%s' in vhost '/' not empty", name)
+	}
+	deleted := len(queue.messages)
+	b.deleteQueue(queue)
+	return deleted, nil
+}
+
+func (ch *memoryChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	for _, consumer := range ch.consumers {
+		b.dispatch(consumer.queue)
+	}
+	return nil
+}
+
+func (ch *memoryChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	routed, err := b.route(exchange, key, msg)
+	if err != nil {
+		if amqpErr, ok := err.(*amqp.Error); ok {
+			ch.shutdown(amqpErr)
+		}
+		return err
+	}
+
+	if mandatory && routed == 0 {
+		returned := amqp.Return{
+			ReplyCode:       amqp.NoRoute,
+			ReplyText:       "NO_ROUTE",
+			Exchange:        exchange,
+			RoutingKey:      key,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			Headers:         msg.Headers,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Body:            msg.Body,
+		}
+		listeners := append([]chan amqp.Return(nil), ch.notifyReturn...)
+		ch.events.push(func() {
+			for _, listener := range listeners {
+				listener <- returned
+			}
+		})
+	}
+	if ch.confirming {
+		ch.publishSeq++
+		confirmation := amqp.Confirmation{DeliveryTag: ch.publishSeq, Ack: true}
+		listeners := append([]chan amqp.Confirmation(nil), ch.notifyPublish...)
+		ch.events.push(func() {
+			for _, listener := range listeners {
+				listener <- confirmation
+			}
+		})
+	}
+	return nil
+}
+
+func (ch *memoryChannel) Confirm(noWait bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirming = true
+	return nil
+}
+
+func (ch *memoryChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		close(confirm)
+		return confirm
+	}
+	ch.notifyPublish = append(ch.notifyPublish, confirm)
+	return confirm
+}
+
+func (ch *memoryChannel) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		close(returns)
+		return returns
+	}
+	ch.notifyReturn = append(ch.notifyReturn, returns)
+	return returns
+}
+
+func (ch *memoryChannel) Consume(queueName, consumerTag string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	queue, ok := b.queues[queueName]
+	if !ok {
+		return nil, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", queueName)
+	}
+	if queue.exclusive && queue.owner != ch.connection {
+		return nil, ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s' in vhost '/'", queueName)
+	}
+	if consumerTag == "" {
+		consumerTag = b.generateName("ctag")
+	}
+	if _, ok := ch.consumers[consumerTag]; ok {
+		return nil, ch.fail(amqp.NotAllowed, "NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumerTag)
+	}
+	for _, consumer := range queue.consumers {
+		if exclusive || consumer.exclusive {
+			return nil, ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - queue '%s' in vhost '/' in exclusive use", queueName)
+		}
+	}
+
+	consumer := &memoryConsumer{
+		tag:        consumerTag,
+		channel:    ch,
+		queue:      queue,
+		autoAck:    autoAck,
+		exclusive:  exclusive,
+		ready:      sync.NewCond(&b.mu),
+		deliveries: make(chan amqp.Delivery),
+		done:       make(chan struct{}),
+	}
+	ch.consumers[consumerTag] = consumer
+	queue.consumers = append(queue.consumers, consumer)
+	queue.consumed = true
+	go consumer.run()
+
+	b.dispatch(queue)
+	return consumer.deliveries, nil
+}
+
+func (ch *memoryChannel) Get(queueName string, autoAck bool) (amqp.Delivery, bool, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+	queue, ok := b.queues[queueName]
+	if !ok {
+		return amqp.Delivery{}, false, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", queueName)
+	}
+	b.expire(queue)
+	if len(queue.messages) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+
+	message := queue.messages[0]
+	queue.messages = queue.messages[1:]
+	ch.deliveryTag++
+	if !autoAck {
+		ch.unacked[ch.deliveryTag] = &memoryUnacked{message: message, queue: queue}
+	}
+	delivery := newDelivery(ch, message, ch.deliveryTag)
+	delivery.MessageCount = uint32(len(queue.messages))
+	return delivery, true, nil
+}
+
+func (ch *memoryChannel) Cancel(consumerTag string, noWait bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	consumer, ok := ch.consumers[consumerTag]
+	if !ok {
+		return nil
+	}
+	consumer.cancel()
+	consumer.queue.removeConsumer(consumer)
+	delete(ch.consumers, consumerTag)
+	ch.releaseQueue(consumer.queue)
+	return nil
+}
+
+func (ch *memoryChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		close(receiver)
+		return receiver
+	}
+	ch.notifyClose = append(ch.notifyClose, receiver)
+	return receiver
+}
+
+func (ch *memoryChannel) Close() error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.shutdown(nil)
+	return nil
+}
+
+func (ch *memoryChannel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, multiple, func(unacked *memoryUnacked) {})
+}
+
+func (ch *memoryChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	b := ch.broker()
+	return ch.settle(tag, multiple, func(unacked *memoryUnacked) {
+		if requeue {
+			b.requeue(unacked.queue, unacked.message)
+			return
+		}
+		b.deadLetter(unacked.queue, unacked.message, "rejected")
+	})
+}
+
+func (ch *memoryChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+func (ch *memoryChannel) settle(tag uint64, multiple bool, settle func(*memoryUnacked)) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	tags := []uint64{}
+	if multiple {
+		for t := range ch.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	} else if _, ok := ch.unacked[tag]; ok {
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - unknown delivery tag %d", tag)
+	}
+
+	affected := map[*memoryQueue]struct{}{}
+	for _, t := range tags {
+		unacked := ch.unacked[t]
+		delete(ch.unacked, t)
+		if unacked.consumer != nil {
+			unacked.consumer.unacked--
+		}
+		settle(unacked)
+		affected[unacked.queue] = struct{}{}
+	}
+	for queue := range affected {
+		if !queue.deleted {
+			b.dispatch(queue)
+		}
+	}
+	return nil
+}
+
+func (c *memoryConsumer) deliver(message *memoryMessage) {
+	ch := c.channel
+	ch.deliveryTag++
+	if !c.autoAck {
+		ch.unacked[ch.deliveryTag] = &memoryUnacked{message: message, queue: c.queue, consumer: c}
+		c.unacked++
+	}
+
+	delivery := newDelivery(ch, message, ch.deliveryTag)
+	delivery.ConsumerTag = c.tag
+	c.buffer = append(c.buffer, delivery)
+	c.ready.Signal()
+}
+
+func newDelivery(ch *memoryChannel, message *memoryMessage, tag uint64) amqp.Delivery {
+	publishing := message.publishing
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         publishing.Headers,
+		ContentType:     publishing.ContentType,
+		ContentEncoding: publishing.ContentEncoding,
+		DeliveryMode:    publishing.DeliveryMode,
+		Priority:        publishing.Priority,
+		CorrelationId:   publishing.CorrelationId,
+		ReplyTo:         publishing.ReplyTo,
+		Expiration:      publishing.Expiration,
+		MessageId:       publishing.MessageId,
+		Timestamp:       publishing.Timestamp,
+		Type:            publishing.Type,
+		UserId:          publishing.UserId,
+		AppId:           publishing.AppId,
+		DeliveryTag:     tag,
+		Redelivered:     message.redelivered,
+		Exchange:        message.exchange,
+		RoutingKey:      message.routingKey,
+		Body:            publishing.Body,
+	}
+}
+
+func (c *memoryConsumer) cancel() {
+	if c.cancelled {
+		return
+	}
+	c.cancelled = true
+	close(c.done)
+	c.ready.Broadcast()
+}
+
+// run forwards buffered deliveries to the consumer's channel so the broker
+// never blocks on a slow consumer, like the buffering in amqp091.
+func (c *memoryConsumer) run() {
+	defer close(c.deliveries)
+	mu := c.ready.L
+	for {
+		mu.Lock()
+		for len(c.buffer) == 0 && !c.cancelled {
+			c.ready.Wait()
+		}
+		if c.cancelled {
+			c.buffer = nil
+			mu.Unlock()
+			return
+		}
+		delivery := c.buffer[0]
+		c.buffer = c.buffer[1:]
+		mu.Unlock()
+
+		select {
+		case c.deliveries <- delivery:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func newMemoryEvents() *memoryEvents {
+	e := &memoryEvents{wake: make(chan struct{}, 1)}
+	go e.run()
+	return e
+}
+
+// push queues an event; a nil event stops the goroutine once reached.
+func (e *memoryEvents) push(event func()) {
+	e.mu.Lock()
+	e.pending = append(e.pending, event)
+	e.mu.Unlock()
+
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (e *memoryEvents) run() {
+	for range e.wake {
+		for {
+			e.mu.Lock()
+			if len(e.pending) == 0 {
+				e.mu.Unlock()
+				break
+			}
+			event := e.pending[0]
+			e.pending = e.pending[1:]
+			e.mu.Unlock()
+
+			if event == nil {
+				return
+			}
+			event()
+		}
+	}
+}
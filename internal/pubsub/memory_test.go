@@ -0,0 +1,215 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// newTestChannel connects to a new MemoryBroker and opens a channel on it.
+func newTestChannel(t *testing.T) (*MemoryBroker, Broker, Channel) {
+	t.Helper()
+	memory := NewMemoryBroker()
+	broker, err := memory.Connect()
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	channel, err := broker.Channel()
+	if err != nil {
+		t.Fatalf("could not open channel: %v", err)
+	}
+	return memory, broker, channel
+}
+
+func declareBoundQueue(t testing.TB, channel Channel, name, exchange, key string, args amqp.Table) {
+	t.Helper()
+	_, err := channel.QueueDeclare(name, false, false, false, false, args)
+	if err != nil {
+		t.Fatalf("could not declare queue %s: %v", name, err)
+	}
+	if exchange == "" {
+		return
+	}
+	err = channel.QueueBind(name, key, exchange, false, nil)
+	if err != nil {
+		t.Fatalf("could not bind queue %s: %v", name, err)
+	}
+}
+
+func publishBody(t *testing.T, channel Channel, exchange, key, body string) {
+	t.Helper()
+	err := channel.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{Body: []byte(body)})
+	if err != nil {
+		t.Fatalf("could not publish to %s with key %s: %v", exchange, key, err)
+	}
+}
+
+// drain gets every message waiting in the queue.
+func drain(t *testing.T, channel Channel, queue string) []amqp.Delivery {
+	t.Helper()
+	deliveries := []amqp.Delivery{}
+	for {
+		delivery, ok, err := channel.Get(queue, true)
+		if err != nil {
+			t.Fatalf("could not get from %s: %v", queue, err)
+		}
+		if !ok {
+			return deliveries
+		}
+		deliveries = append(deliveries, delivery)
+	}
+}
+
+func TestMemoryBrokerTopicRouting(t *testing.T) {
+	_, _, channel := newTestChannel(t)
+	err := channel.ExchangeDeclare("topic", amqp.ExchangeTopic, false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bindings := map[string]string{
+		"one_word":   "army_moves.*",
+		"any_words":  "army_moves.#",
+		"everything": "#",
+		"second":     "*.alice",
+		"exact":      "army_moves.alice",
+	}
+	for queue, key := range bindings {
+		declareBoundQueue(t, channel, queue, "topic", key, nil)
+	}
+
+	tests := []struct {
+		key  string
+		want map[string]bool
+	}{
+		{"army_moves.alice", map[string]bool{"one_word": true, "any_words": true, "everything": true, "second": true, "exact": true}},
+		{"army_moves.bob", map[string]bool{"one_word": true, "any_words": true, "everything": true}},
+		{"army_moves", map[string]bool{"any_words": true, "everything": true}},
+		{"army_moves.alice.extra", map[string]bool{"any_words": true, "everything": true}},
+		{"war.alice", map[string]bool{"everything": true, "second": true}},
+	}
+	for _, test := range tests {
+		publishBody(t, channel, "topic", test.key, test.key)
+		for queue := range bindings {
+			got := drain(t, channel, queue)
+			if test.want[queue] != (len(got) == 1) || len(got) > 1 {
+				t.Errorf("key %s: queue %s (%s) got %d messages, want routed %v", test.key, queue, bindings[queue], len(got), test.want[queue])
+			}
+		}
+	}
+}
+
+func TestMemoryBrokerDirectRouting(t *testing.T) {
+	_, _, channel := newTestChannel(t)
+	err := channel.ExchangeDeclare("direct", amqp.ExchangeDirect, false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	declareBoundQueue(t, channel, "pause.alice", "direct", "pause", nil)
+	declareBoundQueue(t, channel, "pause.bob", "direct", "pause", nil)
+	declareBoundQueue(t, channel, "usernames", "direct", "usernames", nil)
+
+	publishBody(t, channel, "direct", "pause", "paused")
+	publishBody(t, channel, "direct", "pause.alice", "not a binding key")
+	// the default exchange routes by queue name
+	publishBody(t, channel, "", "usernames", "claim")
+
+	for queue, want := range map[string]string{"pause.alice": "paused", "pause.bob": "paused", "usernames": "claim"} {
+		got := drain(t, channel, queue)
+		if len(got) != 1 || string(got[0].Body) != want {
+			t.Errorf("queue %s got %d messages, want only %q", queue, len(got), want)
+		}
+	}
+}
+
+func TestMemoryBrokerReturnsUnroutableMandatory(t *testing.T) {
+	_, _, channel := newTestChannel(t)
+	returns := channel.NotifyReturn(make(chan amqp.Return, 1))
+
+	err := channel.PublishWithContext(context.Background(), "", "nobody", true, false, amqp.Publishing{MessageId: "lost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case returned := <-returns:
+		if returned.ReplyCode != amqp.NoRoute || returned.MessageId != "lost" {
+			t.Errorf("got return %d for %q, want %d for \"lost\"", returned.ReplyCode, returned.MessageId, amqp.NoRoute)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unroutable mandatory message was not returned")
+	}
+}
+
+func TestMemoryBrokerDeadLetterRouting(t *testing.T) {
+	_, _, channel := newTestChannel(t)
+	err := channel.ExchangeDeclare("dlx", amqp.ExchangeFanout, false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	declareBoundQueue(t, channel, "dlq", "dlx", "", nil)
+	declareBoundQueue(t, channel, "work", "", "", amqp.Table{"x-dead-letter-exchange": "dlx"})
+	declareBoundQueue(t, channel, "expiring", "", "", amqp.Table{
+		"x-dead-letter-exchange": "dlx",
+		"x-message-ttl":          int32(10),
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		publishBody(t, channel, "", "work", "rejected")
+		delivery, ok, err := channel.Get("work", false)
+		if err != nil || !ok {
+			t.Fatalf("could not get message: %v", err)
+		}
+		err = delivery.Nack(false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := drain(t, channel, "dlq")
+		if len(got) != 1 {
+			t.Fatalf("dead-letter queue has %d messages, want 1", len(got))
+		}
+		headers := got[0].Headers
+		if headers["x-first-death-queue"] != "work" || headers["x-first-death-reason"] != "rejected" {
+			t.Errorf("got first death %v in %v, want rejected in work", headers["x-first-death-reason"], headers["x-first-death-queue"])
+		}
+		deaths, _ := headers["x-death"].([]interface{})
+		if len(deaths) != 1 || deaths[0].(amqp.Table)["count"] != int64(1) {
+			t.Errorf("got x-death %v, want one death", deaths)
+		}
+	})
+
+	t.Run("requeued is not dead-lettered", func(t *testing.T) {
+		publishBody(t, channel, "", "work", "requeued")
+		delivery, _, _ := channel.Get("work", false)
+		delivery.Nack(false, true)
+
+		again := drain(t, channel, "work")
+		if len(again) != 1 || !again[0].Redelivered {
+			t.Fatalf("got %d messages back, want the redelivered one", len(again))
+		}
+		if got := drain(t, channel, "dlq"); len(got) != 0 {
+			t.Errorf("dead-letter queue has %d messages, want none", len(got))
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		publishBody(t, channel, "", "expiring", "expired")
+		deadline := time.Now().Add(time.Second)
+		for {
+			got := drain(t, channel, "dlq")
+			if len(got) == 1 {
+				if got[0].Headers["x-first-death-reason"] != "expired" {
+					t.Errorf("got reason %v, want expired", got[0].Headers["x-first-death-reason"])
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("expired message was not dead-lettered")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,190 @@
+package pubsub
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Message is a delivery as middleware sees it: the decoded payload with its
+// metadata, and the queue it was consumed from.
+type Message struct {
+	Envelope[any]
+	Queue string
+
+	delivery          amqp.Delivery
+	mu                sync.Mutex
+	deadLetterHeaders amqp.Table
+}
+
+// Handler handles a message. Subscribe and SubscribeEnvelope adapt their
+// typed handlers to it.
+type Handler func(message *Message) AckType
+
+// Middleware wraps a handler, for example to log or time it.
+type Middleware func(next Handler) Handler
+
+// WithMiddleware wraps the subscription's handler. The first middleware is
+// the outermost one.
+func WithMiddleware(middleware ...Middleware) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.middleware = append(o.middleware, middleware...)
+	}
+}
+
+func newMessage(queue string, delivery amqp.Delivery, payload any) *Message {
+	return &Message{
+		Envelope: newEnvelope(payload, delivery),
+		Queue:    queue,
+		delivery: delivery,
+	}
+}
+
+// SetDeadLetterHeader adds a header to the message if the handler result is
+// NackDiscard, so the copy in the dead-letter queue explains what went
+// wrong.
+func (m *Message) SetDeadLetterHeader(key string, value any) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.deadLetterHeaders == nil {
+		m.deadLetterHeaders = amqp.Table{}
+	}
+	m.deadLetterHeaders[key] = value
+}
+
+func (m *Message) headers() amqp.Table {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deadLetterHeaders
+}
+
+func chain(handler Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// handlerPanic carries a panic out of the goroutine Timeout runs the handler
+// in, together with the stack where it happened.
+type handlerPanic struct {
+	value any
+	stack []byte
+}
+
+// Recover turns a panicking handler into NackDiscard. The panic value and
+// stack are logged and set in the x-panic and x-panic-stack headers of the
+// dead-lettered message.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(message *Message) (ack AckType) {
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+				stack := debug.Stack()
+				if p, ok := r.(handlerPanic); ok {
+					r, stack = p.value, p.stack
+				}
+				log.Printf("handler for queue %s panicked: %v\n%s", message.Queue, r, stack)
+				message.SetDeadLetterHeader("x-panic", fmt.Sprint(r))
+				message.SetDeadLetterHeader("x-panic-stack", string(stack))
+				ack = NackDiscard
+			}()
+			return next(message)
+		}
+	}
+}
+
+// Logging logs every handled message with its metadata, result and
+// duration.
+func Logging(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(message *Message) AckType {
+			start := time.Now()
+			ack := next(message)
+			logger.Info("handled message",
+				"queue", message.Queue,
+				"exchange", message.Exchange,
+				"routing_key", message.RoutingKey,
+				"message_id", message.MessageID,
+				"correlation_id", message.CorrelationID,
+				"redelivered", message.Redelivered,
+				"ack", ack.String(),
+				"duration", time.Since(start),
+			)
+			return ack
+		}
+	}
+}
+
+// Latency reports how long the handler took for every message.
+func Latency(observe func(message *Message, ack AckType, duration time.Duration)) Middleware {
+	return func(next Handler) Handler {
+		return func(message *Message) AckType {
+			start := time.Now()
+			ack := next(message)
+			observe(message, ack, time.Since(start))
+			return ack
+		}
+	}
+}
+
+// RedrawPrompt writes prompt to w after every handled message, so that a
+// REPL shows its prompt again after a handler wrote to the terminal.
+func RedrawPrompt(w io.Writer, prompt string) Middleware {
+	return func(next Handler) Handler {
+		return func(message *Message) AckType {
+			defer fmt.Fprint(w, prompt)
+			return next(message)
+		}
+	}
+}
+
+// Timeout settles the message with onTimeout if the handler takes longer
+// than timeout. Handlers cannot be interrupted, so the handler keeps running
+// and its result is ignored.
+func Timeout(timeout time.Duration, onTimeout AckType) Middleware {
+	type result struct {
+		ack      AckType
+		panicked *handlerPanic
+	}
+
+	return func(next Handler) Handler {
+		return func(message *Message) AckType {
+			done := make(chan result, 1)
+			go func() {
+				defer func() {
+					if r := recover(); r != nil {
+						p, ok := r.(handlerPanic)
+						if !ok {
+							p = handlerPanic{value: r, stack: debug.Stack()}
+						}
+						done <- result{panicked: &p}
+					}
+				}()
+				done <- result{ack: next(message)}
+			}()
+
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case r := <-done:
+				if r.panicked != nil {
+					panic(*r.panicked)
+				}
+				return r.ack
+			case <-timer.C:
+				log.Printf("handler for queue %s timed out after %v", message.Queue, timeout)
+				return onTimeout
+			}
+		}
+	}
+}
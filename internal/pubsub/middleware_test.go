@@ -0,0 +1,160 @@
+package pubsub
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func newTestMessage() *Message {
+	return newMessage(testQueue, amqp.Delivery{
+		Exchange:      testExchange,
+		RoutingKey:    testKey,
+		MessageId:     "message-1",
+		CorrelationId: "chain-1",
+	}, testMessage{Key: "a"})
+}
+
+func panickingHandler(message *Message) AckType {
+	panic("boom")
+}
+
+func TestRecoverSetsPanicHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		middleware []Middleware
+	}{
+		{"direct", []Middleware{Recover()}},
+		{"through Timeout", []Middleware{Recover(), Timeout(time.Second, NackRequeue)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := newTestMessage()
+			ack := chain(panickingHandler, test.middleware)(message)
+			if ack != NackDiscard {
+				t.Errorf("got %v, want %v", ack, NackDiscard)
+			}
+
+			headers := message.headers()
+			if headers["x-panic"] != "boom" {
+				t.Errorf("x-panic = %v, want boom", headers["x-panic"])
+			}
+			// the stack is the one of the panic, also when it happened in
+			// the goroutine Timeout runs the handler in
+			stack, _ := headers["x-panic-stack"].(string)
+			if !strings.Contains(stack, "panickingHandler") {
+				t.Errorf("x-panic-stack does not show the handler:\n%s", stack)
+			}
+		})
+	}
+}
+
+func TestRecoverPassesResults(t *testing.T) {
+	message := newTestMessage()
+	ack := Recover()(func(*Message) AckType { return RetryLater })(message)
+	if ack != RetryLater {
+		t.Errorf("got %v, want %v", ack, RetryLater)
+	}
+	if headers := message.headers(); headers != nil {
+		t.Errorf("got dead-letter headers %v without a panic", headers)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	finished := make(chan AckType, 1)
+	handler := Timeout(20*time.Millisecond, NackRequeue)(func(*Message) AckType {
+		<-release
+		finished <- Ack
+		return Ack
+	})
+
+	start := time.Now()
+	ack := handler(newTestMessage())
+	if ack != NackRequeue {
+		t.Errorf("got %v, want the timeout's %v", ack, NackRequeue)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timed out after %v", elapsed)
+	}
+
+	// the handler cannot be interrupted and runs to completion
+	close(release)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not keep running after the timeout")
+	}
+}
+
+func TestTimeoutPassesFastResults(t *testing.T) {
+	handler := Timeout(time.Second, NackRequeue)(func(*Message) AckType { return NackDiscard })
+	ack := handler(newTestMessage())
+	if ack != NackDiscard {
+		t.Errorf("got %v, want the handler's %v", ack, NackDiscard)
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var output bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&output, nil))
+	ack := Logging(logger)(func(*Message) AckType { return RetryLater })(newTestMessage())
+	if ack != RetryLater {
+		t.Errorf("got %v, want %v", ack, RetryLater)
+	}
+
+	line := output.String()
+	for _, want := range []string{
+		"msg=\"handled message\"",
+		"queue=" + testQueue,
+		"exchange=" + testExchange,
+		"routing_key=" + testKey,
+		"message_id=message-1",
+		"correlation_id=chain-1",
+		"redelivered=false",
+		"ack=retry-later",
+		"duration=",
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("log line lacks %s: %s", want, line)
+		}
+	}
+}
+
+func TestLatency(t *testing.T) {
+	var observed struct {
+		message  *Message
+		ack      AckType
+		duration time.Duration
+	}
+	middleware := Latency(func(message *Message, ack AckType, duration time.Duration) {
+		observed.message, observed.ack, observed.duration = message, ack, duration
+	})
+	message := newTestMessage()
+	middleware(func(*Message) AckType {
+		time.Sleep(10 * time.Millisecond)
+		return NackRequeue
+	})(message)
+
+	if observed.message != message || observed.ack != NackRequeue {
+		t.Errorf("observed %p with %v, want %p with %v", observed.message, observed.ack, message, NackRequeue)
+	}
+	if observed.duration < 10*time.Millisecond {
+		t.Errorf("observed %v, want at least the 10ms the handler slept", observed.duration)
+	}
+}
+
+func TestRedrawPrompt(t *testing.T) {
+	var output bytes.Buffer
+	RedrawPrompt(&output, "> ")(func(*Message) AckType {
+		output.WriteString("handled\n")
+		return Ack
+	})(newTestMessage())
+	if output.String() != "handled\n> " {
+		t.Errorf("got %q, want the prompt after the handler's output", output.String())
+	}
+}
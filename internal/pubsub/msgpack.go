@@ -0,0 +1,354 @@
+package pubsub
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// MsgPackCodec encodes messages as MessagePack. Times use the timestamp
+// extension type.
+type MsgPackCodec struct{}
+
+func (MsgPackCodec) ContentType() string {
+	return ContentTypeMsgPack
+}
+
+func (MsgPackCodec) Marshal(v any) ([]byte, error) {
+	w := &msgpackWriter{}
+	err := encodeValue(w, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return w.buffer, nil
+}
+
+func (MsgPackCodec) Unmarshal(data []byte, v any) error {
+	r := &msgpackReader{data: data}
+	decoded, err := r.read(0)
+	if err != nil {
+		return err
+	}
+	if r.offset != len(data) {
+		return fmt.Errorf("msgpack: %d trailing bytes", len(data)-r.offset)
+	}
+	return unmarshalValue(decoded, v)
+}
+
+// msgpackTimestamp is the extension type of timestamps, written as 0xff.
+const msgpackTimestamp = -1
+
+type msgpackWriter struct {
+	buffer []byte
+}
+
+func (w *msgpackWriter) writeNil() {
+	w.buffer = append(w.buffer, 0xc0)
+}
+
+func (w *msgpackWriter) writeBool(v bool) {
+	if v {
+		w.buffer = append(w.buffer, 0xc3)
+	} else {
+		w.buffer = append(w.buffer, 0xc2)
+	}
+}
+
+func (w *msgpackWriter) writeInt(v int64) {
+	switch {
+	case v >= 0:
+		w.writeUint(uint64(v))
+	case v >= -32:
+		w.buffer = append(w.buffer, byte(v))
+	case v >= math.MinInt8:
+		w.buffer = append(w.buffer, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		w.buffer = binary.BigEndian.AppendUint16(append(w.buffer, 0xd1), uint16(v))
+	case v >= math.MinInt32:
+		w.buffer = binary.BigEndian.AppendUint32(append(w.buffer, 0xd2), uint32(v))
+	default:
+		w.buffer = binary.BigEndian.AppendUint64(append(w.buffer, 0xd3), uint64(v))
+	}
+}
+
+func (w *msgpackWriter) writeUint(v uint64) {
+	switch {
+	case v <= 0x7f:
+		w.buffer = append(w.buffer, byte(v))
+	case v <= math.MaxUint8:
+		w.buffer = append(w.buffer, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		w.buffer = binary.BigEndian.AppendUint16(append(w.buffer, 0xcd), uint16(v))
+	case v <= math.MaxUint32:
+		w.buffer = binary.BigEndian.AppendUint32(append(w.buffer, 0xce), uint32(v))
+	default:
+		w.buffer = binary.BigEndian.AppendUint64(append(w.buffer, 0xcf), v)
+	}
+}
+
+func (w *msgpackWriter) writeFloat(v float64) {
+	w.buffer = binary.BigEndian.AppendUint64(append(w.buffer, 0xcb), math.Float64bits(v))
+}
+
+func (w *msgpackWriter) writeString(v string) {
+	n := len(v)
+	switch {
+	case n < 32:
+		w.buffer = append(w.buffer, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		w.buffer = append(w.buffer, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		w.buffer = binary.BigEndian.AppendUint16(append(w.buffer, 0xda), uint16(n))
+	default:
+		w.buffer = binary.BigEndian.AppendUint32(append(w.buffer, 0xdb), uint32(n))
+	}
+	w.buffer = append(w.buffer, v...)
+}
+
+func (w *msgpackWriter) writeBytes(v []byte) {
+	n := len(v)
+	switch {
+	case n <= math.MaxUint8:
+		w.buffer = append(w.buffer, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		w.buffer = binary.BigEndian.AppendUint16(append(w.buffer, 0xc5), uint16(n))
+	default:
+		w.buffer = binary.BigEndian.AppendUint32(append(w.buffer, 0xc6), uint32(n))
+	}
+	w.buffer = append(w.buffer, v...)
+}
+
+// writeTime always uses the 96-bit timestamp format, which covers every
+// time.Time value.
+func (w *msgpackWriter) writeTime(v time.Time) {
+	w.buffer = append(w.buffer, 0xc7, 12, 0xff)
+	w.buffer = binary.BigEndian.AppendUint32(w.buffer, uint32(v.Nanosecond()))
+	w.buffer = binary.BigEndian.AppendUint64(w.buffer, uint64(v.Unix()))
+}
+
+func (w *msgpackWriter) writeArrayHeader(n int) {
+	switch {
+	case n < 16:
+		w.buffer = append(w.buffer, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		w.buffer = binary.BigEndian.AppendUint16(append(w.buffer, 0xdc), uint16(n))
+	default:
+		w.buffer = binary.BigEndian.AppendUint32(append(w.buffer, 0xdd), uint32(n))
+	}
+}
+
+func (w *msgpackWriter) writeMapHeader(n int) {
+	switch {
+	case n < 16:
+		w.buffer = append(w.buffer, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		w.buffer = binary.BigEndian.AppendUint16(append(w.buffer, 0xde), uint16(n))
+	default:
+		w.buffer = binary.BigEndian.AppendUint32(append(w.buffer, 0xdf), uint32(n))
+	}
+}
+
+var errMsgPackTruncated = errors.New("msgpack: unexpected end of data")
+
+type msgpackReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *msgpackReader) take(n int) ([]byte, error) {
+	if n < 0 || len(r.data)-r.offset < n {
+		return nil, errMsgPackTruncated
+	}
+	b := r.data[r.offset : r.offset+n]
+	r.offset += n
+	return b, nil
+}
+
+func (r *msgpackReader) uint(size int) (uint64, error) {
+	b, err := r.take(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+func (r *msgpackReader) read(depth int) (any, error) {
+	if depth > maxDecodeDepth {
+		return nil, errors.New("msgpack: data nested too deeply")
+	}
+	b, err := r.take(1)
+	if err != nil {
+		return nil, err
+	}
+	code := b[0]
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xe0 == 0xa0:
+		return r.str(int(code & 0x1f))
+	case code&0xf0 == 0x90:
+		return r.array(int(code&0x0f), depth)
+	case code&0xf0 == 0x80:
+		return r.mapping(int(code&0x0f), depth)
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return r.uint(1 << (code - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		n, err := r.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// sign-extend from the encoded width
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, nil
+
+	case 0xca:
+		n, err := r.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 0xcb:
+		n, err := r.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(n), nil
+
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.uint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return r.str(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.uint(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.take(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, data...), nil
+
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.array(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.mapping(int(n), depth)
+
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return r.ext(1 << (code - 0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := r.uint(1 << (code - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return r.ext(int(n))
+	}
+	return nil, fmt.Errorf("msgpack: invalid type code 0x%02x", code)
+}
+
+func (r *msgpackReader) str(n int) (any, error) {
+	data, err := r.take(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (r *msgpackReader) array(n int, depth int) (any, error) {
+	// every item takes at least one byte
+	if n > len(r.data)-r.offset {
+		return nil, errMsgPackTruncated
+	}
+	items := make([]any, n)
+	for i := range items {
+		item, err := r.read(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = item
+	}
+	return items, nil
+}
+
+func (r *msgpackReader) mapping(n int, depth int) (any, error) {
+	if 2*n > len(r.data)-r.offset {
+		return nil, errMsgPackTruncated
+	}
+	entries := make([]mapEntry, n)
+	for i := range entries {
+		key, err := r.read(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.read(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = mapEntry{key: key, value: value}
+	}
+	return entries, nil
+}
+
+func (r *msgpackReader) ext(n int) (any, error) {
+	b, err := r.take(1)
+	if err != nil {
+		return nil, err
+	}
+	kind := int8(b[0])
+	data, err := r.take(n)
+	if err != nil {
+		return nil, err
+	}
+	if kind != msgpackTimestamp {
+		return nil, fmt.Errorf("msgpack: unsupported extension type %d", kind)
+	}
+
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+	case 8:
+		n := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(n&0x3ffffffff), int64(n>>34)), nil
+	case 12:
+		nanoseconds := binary.BigEndian.Uint32(data)
+		seconds := int64(binary.BigEndian.Uint64(data[4:]))
+		return time.Unix(seconds, int64(nanoseconds)), nil
+	}
+	return nil, fmt.Errorf("msgpack: invalid timestamp length %d", n)
+}
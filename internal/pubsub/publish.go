@@ -1,61 +1,100 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
 	"fmt"
 
+	"github.com/speady1445/learn-pub-sub-starter/internal/routing"
+
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	marshaledJSON, err := json.Marshal(val)
+type publishOptions struct {
+	codec         Codec
+	correlationID string
+	headers       amqp.Table
+}
+
+type PublishOption func(*publishOptions)
+
+// WithCodec selects the codec the message is encoded with. The default is
+// JSON.
+func WithCodec(codec Codec) PublishOption {
+	return func(o *publishOptions) {
+		o.codec = codec
+	}
+}
+
+// WithCorrelationID sets the correlation ID of the message, taking
+// precedence over one carried by the context.
+func WithCorrelationID(id string) PublishOption {
+	return func(o *publishOptions) {
+		o.correlationID = id
+	}
+}
+
+func WithHeaders(headers amqp.Table) PublishOption {
+	return func(o *publishOptions) {
+		o.headers = headers
+	}
+}
+
+func Publish[T any](ctx context.Context, publisher *Publisher, exchange string, key routing.RoutingKey, val T, options ...PublishOption) error {
+	o := publishOptions{codec: JSONCodec{}}
+	for _, option := range options {
+		option(&o)
+	}
+
+	body, err := o.codec.Marshal(val)
 	if err != nil {
-		return fmt.Errorf("error marshalling JSON: %v", err)
+		return fmt.Errorf("error encoding %s: %v", o.codec.ContentType(), err)
 	}
 
-	err = ch.PublishWithContext(
-		context.Background(),
+	err = publisher.Publish(
+		ctx,
 		exchange,
-		key,
-		false,
-		false,
+		string(key),
 		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        marshaledJSON,
+			Headers:       withSchema[T](o.headers),
+			ContentType:   o.codec.ContentType(),
+			CorrelationId: o.correlationID,
+			Body:          body,
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("error publishing message: %v", err)
+		return fmt.Errorf("error publishing message: %w", err)
 	}
 
 	return nil
 }
 
-func PublishGob[T any](channel *amqp.Channel, exchange, key string, value T) error {
-	var buffer bytes.Buffer
-	encoder := gob.NewEncoder(&buffer)
-	err := encoder.Encode(value)
-	if err != nil {
-		return fmt.Errorf("error encoding gob: %v", err)
+// PublishBatch encodes vals and publishes them in order with a single
+// channel, see Publisher.PublishBatch. Failed messages are reported by a
+// *BatchError, with the index of their value.
+func PublishBatch[T any](ctx context.Context, publisher *Publisher, exchange string, key routing.RoutingKey, vals []T, options ...PublishOption) error {
+	o := publishOptions{codec: JSONCodec{}}
+	for _, option := range options {
+		option(&o)
 	}
 
-	err = channel.PublishWithContext(
-		context.Background(),
-		exchange,
-		key,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/gob",
-			Body:        buffer.Bytes(),
-		},
-	)
-	if err != nil {
-		return fmt.Errorf("error publishing message: %v", err)
+	headers := withSchema[T](o.headers)
+	msgs := make([]amqp.Publishing, len(vals))
+	for i, val := range vals {
+		body, err := o.codec.Marshal(val)
+		if err != nil {
+			return fmt.Errorf("error encoding %s message %d: %v", o.codec.ContentType(), i, err)
+		}
+		msgs[i] = amqp.Publishing{
+			Headers:       headers,
+			ContentType:   o.codec.ContentType(),
+			CorrelationId: o.correlationID,
+			Body:          body,
+		}
 	}
 
+	err := publisher.PublishBatch(ctx, exchange, string(key), msgs)
+	if err != nil {
+		return fmt.Errorf("error publishing batch: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,281 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	ErrNacked             = errors.New("message was nacked by the broker")
+	ErrConfirmChannelLost = errors.New("channel closed before the broker confirmed the message")
+)
+
+// ReturnedError is returned for mandatory messages the broker could not route
+// to any queue.
+type ReturnedError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *ReturnedError) Error() string {
+	return fmt.Sprintf("message to exchange %q with key %q was returned: %d %s", e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+type PublisherOptions struct {
+	// Confirm puts the channel into confirm mode and publishes with the
+	// mandatory flag, so Publish waits for the broker ack and reports nacks
+	// and unroutable messages as errors.
+	Confirm bool
+	// AppID is set on every message. It defaults to the name of the running
+	// program.
+	AppID string
+	// PoolSize is the number of channels messages are published on
+	// concurrently. It defaults to 1.
+	PoolSize int
+}
+
+// Publisher publishes on a pool of channels it owns and is safe for
+// concurrent use. Each channel is used by one Publish call at a time and is
+// replaced by a new one whenever it was closed, for example after a
+// reconnect.
+type Publisher struct {
+	broker  Broker
+	options PublisherOptions
+
+	idle chan *publisherChannel
+	done chan struct{}
+	once sync.Once
+}
+
+// publisherChannel is a pooled channel together with the notification
+// channels registered on it.
+type publisherChannel struct {
+	channel  Channel
+	closed   chan *amqp.Error
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+func NewPublisher(broker Broker, options PublisherOptions) *Publisher {
+	if options.AppID == "" {
+		options.AppID = filepath.Base(os.Args[0])
+	}
+	if options.PoolSize < 1 {
+		options.PoolSize = 1
+	}
+
+	p := &Publisher{
+		broker:  broker,
+		options: options,
+		idle:    make(chan *publisherChannel, options.PoolSize),
+		done:    make(chan struct{}),
+	}
+	for i := 0; i < options.PoolSize; i++ {
+		// channels are opened on first use
+		p.idle <- &publisherChannel{}
+	}
+	return p
+}
+
+// Publish publishes msg, filling in its message ID, timestamp and app ID if
+// they are not set, and its correlation ID from ctx. It waits for a free
+// channel if all of them are in use.
+func (p *Publisher) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	p.prepare(ctx, &msg)
+
+	pc, err := p.take(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		p.idle <- pc
+	}()
+
+	channel, err := p.acquire(ctx, pc)
+	if err != nil {
+		return err
+	}
+	err = channel.PublishWithContext(ctx, exchange, key, p.options.Confirm, false, msg)
+	if errors.Is(err, amqp.ErrClosed) {
+		pc.release()
+		channel, err = p.acquire(ctx, pc)
+		if err != nil {
+			return err
+		}
+		err = channel.PublishWithContext(ctx, exchange, key, p.options.Confirm, false, msg)
+	}
+	if err != nil || !p.options.Confirm {
+		return err
+	}
+	return pc.waitConfirm(ctx)
+}
+
+func (p *Publisher) prepare(ctx context.Context, msg *amqp.Publishing) {
+	if msg.MessageId == "" {
+		msg.MessageId = newID()
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	if msg.AppId == "" {
+		msg.AppId = p.options.AppID
+	}
+	if msg.CorrelationId == "" {
+		msg.CorrelationId = CorrelationIDFromContext(ctx)
+	}
+}
+
+// take waits for an idle channel of the pool.
+func (p *Publisher) take(ctx context.Context) (*publisherChannel, error) {
+	select {
+	case <-p.done:
+		return nil, amqp.ErrClosed
+	default:
+	}
+
+	select {
+	case pc := <-p.idle:
+		select {
+		case <-p.done:
+			// Close is waiting for this channel
+			p.idle <- pc
+			return nil, amqp.ErrClosed
+		default:
+			return pc, nil
+		}
+	case <-p.done:
+		return nil, amqp.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (pc *publisherChannel) waitConfirm(ctx context.Context) error {
+	var returned *amqp.Return
+	returns := pc.returns
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			returned = &r
+		case confirmation, ok := <-pc.confirms:
+			if !ok {
+				pc.release()
+				return ErrConfirmChannelLost
+			}
+			// the broker sends basic.return before the ack of the same message
+			select {
+			case r, ok := <-returns:
+				if ok {
+					returned = &r
+				}
+			default:
+			}
+			if !confirmation.Ack {
+				return ErrNacked
+			}
+			if returned != nil {
+				return &ReturnedError{
+					Exchange:   returned.Exchange,
+					RoutingKey: returned.RoutingKey,
+					ReplyCode:  returned.ReplyCode,
+					ReplyText:  returned.ReplyText,
+				}
+			}
+			return nil
+		case <-ctx.Done():
+			// a late confirm would be matched to the next message, so the
+			// channel cannot be reused
+			pc.release()
+			return ctx.Err()
+		}
+	}
+}
+
+// Close waits for publishes in progress and closes every channel of the
+// pool. Publishing afterwards fails with amqp.ErrClosed.
+func (p *Publisher) Close() error {
+	var err error
+	p.once.Do(func() {
+		close(p.done)
+		for i := 0; i < p.options.PoolSize; i++ {
+			pc := <-p.idle
+			closeErr := pc.release()
+			if err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+// release closes the channel. Confirms and returns nobody waits for anymore
+// are drained until the channel is closed, since the amqp library blocks
+// delivering them, and with it Close.
+func (pc *publisherChannel) release() error {
+	if pc.channel == nil {
+		return nil
+	}
+	if pc.confirms != nil {
+		go func(confirms chan amqp.Confirmation) {
+			for range confirms {
+			}
+		}(pc.confirms)
+		go func(returns chan amqp.Return) {
+			for range returns {
+			}
+		}(pc.returns)
+	}
+	err := pc.channel.Close()
+	pc.channel, pc.confirms, pc.returns = nil, nil, nil
+	return err
+}
+
+// acquire returns the open channel of pc, replacing it if it has been
+// closed.
+func (p *Publisher) acquire(ctx context.Context, pc *publisherChannel) (Channel, error) {
+	if pc.channel != nil {
+		select {
+		case <-pc.closed:
+			pc.channel = nil
+		default:
+			return pc.channel, nil
+		}
+	}
+
+	var channel Channel
+	var err error
+	if managed, ok := p.broker.(*ManagedBroker); ok {
+		channel, err = managed.channel(ctx)
+	} else {
+		channel, err = p.broker.Channel()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.options.Confirm {
+		err = channel.Confirm(false)
+		if err != nil {
+			channel.Close()
+			return nil, fmt.Errorf("could not put channel into confirm mode: %v", err)
+		}
+		pc.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+		pc.returns = channel.NotifyReturn(make(chan amqp.Return, 1))
+	}
+	pc.channel = channel
+	pc.closed = channel.NotifyClose(make(chan *amqp.Error, 1))
+	return channel, nil
+}
@@ -0,0 +1,120 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// channelRecorder keeps the channels opened on a broker, so a test can close
+// them behind the back of their user.
+type channelRecorder struct {
+	Broker
+
+	mu       sync.Mutex
+	channels []Channel
+}
+
+func (r *channelRecorder) Channel() (Channel, error) {
+	channel, err := r.Broker.Channel()
+	if err == nil {
+		r.mu.Lock()
+		r.channels = append(r.channels, channel)
+		r.mu.Unlock()
+	}
+	return channel, err
+}
+
+func (r *channelRecorder) closeLatest() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.channels) > 0 {
+		r.channels[len(r.channels)-1].Close()
+	}
+}
+
+// TestPublisherConcurrentPublish is meant to be run with -race.
+func TestPublisherConcurrentPublish(t *testing.T) {
+	const (
+		publishers = 32
+		messages   = 50
+	)
+	broker, channel := newSubscribeTest(t)
+	declareBoundQueue(t, channel, testQueue, testExchange, testKey, nil)
+	recorder := &channelRecorder{Broker: broker}
+	publisher := NewPublisher(recorder, PublisherOptions{Confirm: true, PoolSize: 4})
+	defer publisher.Close()
+
+	stop := make(chan struct{})
+	closer := make(chan struct{})
+	go func() {
+		defer close(closer)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(2 * time.Millisecond):
+				recorder.closeLatest()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < messages; i++ {
+				msg := testMessage{Key: fmt.Sprint(p), Sequence: i}
+				for {
+					err := Publish(context.Background(), publisher, testExchange, testKey, msg)
+					if errors.Is(err, ErrConfirmChannelLost) {
+						// the channel was closed before the confirm arrived
+						continue
+					}
+					if err != nil {
+						t.Errorf("could not publish %+v: %v", msg, err)
+					}
+					break
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(stop)
+	<-closer
+
+	recorder.mu.Lock()
+	opened := len(recorder.channels)
+	recorder.mu.Unlock()
+	if opened <= 4 {
+		t.Errorf("publisher opened %d channels, so none was replaced", opened)
+	}
+
+	// messages whose confirm was lost may have been published twice
+	seen := map[string]bool{}
+	for _, delivery := range drain(t, channel, testQueue) {
+		seen[string(delivery.Body)] = true
+	}
+	if len(seen) != publishers*messages {
+		t.Errorf("got %d distinct messages, want %d", len(seen), publishers*messages)
+	}
+}
+
+func TestPublisherClosed(t *testing.T) {
+	broker, _ := newSubscribeTest(t)
+	publisher := NewPublisher(broker, PublisherOptions{PoolSize: 2})
+	err := publisher.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = publisher.Publish(context.Background(), testExchange, testKey, amqp.Publishing{})
+	if !errors.Is(err, amqp.ErrClosed) {
+		t.Errorf("got %v after Close, want amqp.ErrClosed", err)
+	}
+}
@@ -0,0 +1,310 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrDisconnected = errors.New("broker is disconnected")
+
+type ReconnectPolicy int
+
+const (
+	// WaitForReconnect blocks callers that need a channel until the
+	// connection has been re-established.
+	WaitForReconnect ReconnectPolicy = iota
+	// FailFast returns ErrDisconnected while the connection is down.
+	FailFast
+)
+
+type ReconnectOptions struct {
+	Policy ReconnectPolicy
+	// MinBackoff defaults to 500 milliseconds. MaxBackoff defaults to 30
+	// seconds, or to MinBackoff if that is longer, and is raised to
+	// MinBackoff if it is set lower.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func (o ReconnectOptions) withDefaults() ReconnectOptions {
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = 500 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 30 * time.Second
+	}
+	o.MaxBackoff = max(o.MaxBackoff, o.MinBackoff)
+	return o
+}
+
+// recoverer is implemented by anything that has to be set up again on a new
+// connection, such as a subscription's queue, bindings, QoS and consumer.
+type recoverer interface {
+	setup(broker Broker) error
+}
+
+// ManagedBroker wraps a Broker created by dial, watches it for closure and
+// reconnects with exponential backoff, recovering every registered
+// subscription on the new connection.
+type ManagedBroker struct {
+	dial    func() (Broker, error)
+	options ReconnectOptions
+
+	mu          sync.Mutex
+	current     Broker
+	ready       chan struct{}
+	recoverers  []recoverer
+	notifyClose []chan *amqp.Error
+	closed      bool
+	done        chan struct{}
+}
+
+func NewManagedBroker(dial func() (Broker, error), options ReconnectOptions) (*ManagedBroker, error) {
+	options = options.withDefaults()
+	broker, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &ManagedBroker{
+		dial:    dial,
+		options: options,
+		current: broker,
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	close(m.ready)
+	go m.watch(broker, broker.NotifyClose(make(chan *amqp.Error, 1)))
+	return m, nil
+}
+
+func (m *ManagedBroker) Channel() (Channel, error) {
+	return m.channel(context.Background())
+}
+
+func (m *ManagedBroker) channel(ctx context.Context) (Channel, error) {
+	for {
+		broker, err := m.wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+		channel, err := broker.Channel()
+		if errors.Is(err, amqp.ErrClosed) {
+			// the close notification has not been processed yet
+			m.disconnected(broker)
+			continue
+		}
+		return channel, err
+	}
+}
+
+// wait returns the current connection, waiting for a reconnect or failing
+// with ErrDisconnected according to the policy.
+func (m *ManagedBroker) wait(ctx context.Context) (Broker, error) {
+	for {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return nil, amqp.ErrClosed
+		}
+		broker, ready := m.current, m.ready
+		m.mu.Unlock()
+
+		if broker != nil {
+			return broker, nil
+		}
+		if m.options.Policy == FailFast {
+			return nil, ErrDisconnected
+		}
+
+		select {
+		case <-ready:
+		case <-m.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (m *ManagedBroker) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		close(receiver)
+		return receiver
+	}
+	m.notifyClose = append(m.notifyClose, receiver)
+	return receiver
+}
+
+func (m *ManagedBroker) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	m.closed = true
+	close(m.done)
+	broker := m.current
+	m.current = nil
+	listeners := m.notifyClose
+	m.notifyClose = nil
+	m.mu.Unlock()
+
+	for _, listener := range listeners {
+		close(listener)
+	}
+	if broker != nil {
+		return broker.Close()
+	}
+	return nil
+}
+
+// register adds r to the set recovered after every reconnect and starts it on
+// the current connection, if there is one.
+func (m *ManagedBroker) register(r recoverer) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	broker := m.current
+	if broker == nil && m.options.Policy == FailFast {
+		m.mu.Unlock()
+		return ErrDisconnected
+	}
+	m.recoverers = append(m.recoverers, r)
+	m.mu.Unlock()
+
+	if broker == nil {
+		return nil
+	}
+	err := r.setup(broker)
+	if err != nil && m.reconnected(broker) {
+		// the connection was replaced while starting, recovery has taken over
+		return nil
+	}
+	return err
+}
+
+func (m *ManagedBroker) unregister(r recoverer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, registered := range m.recoverers {
+		if registered == r {
+			m.recoverers = append(m.recoverers[:i:i], m.recoverers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *ManagedBroker) disconnected(broker Broker) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.current == broker {
+		m.current = nil
+		m.ready = make(chan struct{})
+	}
+}
+
+func (m *ManagedBroker) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+func (m *ManagedBroker) reconnected(broker Broker) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.current != broker
+}
+
+func (m *ManagedBroker) watch(broker Broker, closed chan *amqp.Error) {
+	err := <-closed
+	if m.isClosed() {
+		return
+	}
+	m.disconnected(broker)
+
+	log.Printf("lost connection to broker: %v", err)
+	m.reconnect()
+}
+
+func (m *ManagedBroker) reconnect() {
+	backoff := m.options.MinBackoff
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > m.options.MaxBackoff {
+			backoff = m.options.MaxBackoff
+		}
+
+		broker, err := m.dial()
+		if err != nil {
+			log.Printf("could not reconnect to broker: %v", err)
+			continue
+		}
+		closed := broker.NotifyClose(make(chan *amqp.Error, 1))
+
+		err = m.recover(broker)
+		if err != nil && m.isClosed() {
+			broker.Close()
+			return
+		}
+		if err != nil {
+			log.Printf("could not recover subscriptions: %v", err)
+			broker.Close()
+			continue
+		}
+
+		log.Printf("reconnected to broker")
+		go m.watch(broker, closed)
+		return
+	}
+}
+
+// recover sets up every registered recoverer on broker and publishes it as
+// the current connection. Recoverers registered while this runs are picked
+// up before the connection is handed out.
+func (m *ManagedBroker) recover(broker Broker) error {
+	recovered := map[recoverer]bool{}
+	for {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return amqp.ErrClosed
+		}
+		pending := []recoverer{}
+		for _, r := range m.recoverers {
+			if !recovered[r] {
+				pending = append(pending, r)
+			}
+		}
+		if len(pending) == 0 {
+			m.current = broker
+			close(m.ready)
+			m.mu.Unlock()
+			return nil
+		}
+		m.mu.Unlock()
+
+		for _, r := range pending {
+			err := r.setup(broker)
+			if err != nil {
+				return err
+			}
+			recovered[r] = true
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoffDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  ReconnectOptions
+		min, max time.Duration
+	}{
+		{"defaults", ReconnectOptions{}, 500 * time.Millisecond, 30 * time.Second},
+		{"MaxBackoff set", ReconnectOptions{MaxBackoff: 5 * time.Second}, 500 * time.Millisecond, 5 * time.Second},
+		{"MinBackoff above the default cap", ReconnectOptions{MinBackoff: time.Minute}, time.Minute, time.Minute},
+		{"MaxBackoff below MinBackoff", ReconnectOptions{MinBackoff: 2 * time.Second, MaxBackoff: time.Second}, 2 * time.Second, 2 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.options.withDefaults()
+			if got.MinBackoff != test.min || got.MaxBackoff != test.max {
+				t.Errorf("got backoff from %v to %v, want from %v to %v", got.MinBackoff, got.MaxBackoff, test.min, test.max)
+			}
+		})
+	}
+}
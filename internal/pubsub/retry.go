@@ -0,0 +1,132 @@
+package pubsub
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// RetryOptions configures how messages handled with RetryLater are retried.
+// Attempt n waits MinBackoff * 2^(n-1), at most MaxBackoff. Once MaxAttempts
+// retries have failed, the message is dead-lettered. The defaults are 5
+// attempts and a backoff from a second up to a minute, or up to MinBackoff if
+// that is longer. A MaxBackoff below MinBackoff is raised to MinBackoff.
+type RetryOptions struct {
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+func WithRetry(options RetryOptions) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retry = options
+	}
+}
+
+func (o RetryOptions) withDefaults() RetryOptions {
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 5
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = time.Second
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = time.Minute
+	}
+	o.MaxBackoff = max(o.MaxBackoff, o.MinBackoff)
+	return o
+}
+
+func (o RetryOptions) delay(attempt int64) time.Duration {
+	delay := o.MinBackoff
+	for i := int64(1); i < attempt && delay < o.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, o.MaxBackoff)
+}
+
+// retry parks the delivery in a retry queue for the backoff of its next
+// attempt. The retry queue has no consumers: when the message's TTL runs
+// out, the queue dead-letters it back to the subscription's queue through
+// the default exchange. The attempt is counted in the x-retry-count header.
+// The delivery is acked once the retry queue confirms its copy.
+func (s *Subscription) retry(c *consumer, delivery amqp.Delivery) {
+	attempt := headerInt(delivery.Headers, "x-retry-count") + 1
+	if attempt > int64(s.options.retry.MaxAttempts) {
+		s.deadLetter(c, delivery, amqp.Table{"x-retry-count": attempt - 1})
+		return
+	}
+
+	delay := s.options.retry.delay(attempt)
+	queueName, err := s.declareRetryQueue(c, delay)
+	if err != nil {
+		log.Printf("could not declare retry queue: %v", err)
+		delivery.Nack(false, true)
+		return
+	}
+
+	publishing := publishingFrom(delivery)
+	setOrigin(publishing.Headers, delivery, c.queue)
+	publishing.Headers["x-retry-count"] = attempt
+	err = s.republish("", queueName, publishing)
+	if err != nil {
+		log.Printf("could not schedule retry: %v", err)
+		delivery.Nack(false, true)
+		return
+	}
+	delivery.Ack(false)
+}
+
+// declareRetryQueue declares the retry queue for delay once per channel.
+// Retry queues of transient subscriptions are exclusive, so they go away
+// together with the queue they feed. Those of shared subscriptions cannot
+// be, since every consuming connection declares the same ones, and having
+// no consumers they would never be auto-deleted either. They expire instead
+// once unused for retryQueueExpiry, and are redeclared while in use so that
+// none expires with a message still waiting in it.
+func (s *Subscription) declareRetryQueue(c *consumer, delay time.Duration) (string, error) {
+	name := fmt.Sprintf("%s.retry.%d", c.queue, delay.Milliseconds())
+	shared := s.simpleQueueType == SimpleQueueShared
+	expiry := retryQueueExpiry(delay)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	declared, ok := c.retryQueues[name]
+	if ok && (!shared || time.Since(declared) < expiry/2) {
+		return name, nil
+	}
+
+	args := amqp.Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": c.queue,
+	}
+	if shared {
+		args["x-expires"] = expiry.Milliseconds()
+	}
+	_, err := c.channel.QueueDeclare(
+		name,
+		s.simpleQueueType == SimpleQueueDurable,
+		false,
+		s.simpleQueueType == SimpleQueueTransient,
+		false,
+		args,
+	)
+	if err != nil {
+		return "", err
+	}
+	if c.retryQueues == nil {
+		c.retryQueues = map[string]time.Time{}
+	}
+	c.retryQueues[name] = time.Now()
+	return name, nil
+}
+
+// retryQueueExpiry is how long a shared retry queue for delay may go unused.
+// Redeclaring it after half of that leaves every message published in
+// between more than enough time to be dead-lettered.
+func retryQueueExpiry(delay time.Duration) time.Duration {
+	return 2*delay + time.Minute
+}
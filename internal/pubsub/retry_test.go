@@ -0,0 +1,112 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		options RetryOptions
+		attempt int64
+		want    time.Duration
+	}{
+		{"first attempt", RetryOptions{}, 1, time.Second},
+		{"doubles", RetryOptions{}, 3, 4 * time.Second},
+		{"capped at the default", RetryOptions{}, 10, time.Minute},
+		{"capped at MaxBackoff", RetryOptions{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}, 4, 5 * time.Second},
+		{"MinBackoff above the default cap", RetryOptions{MinBackoff: 2 * time.Minute}, 1, 2 * time.Minute},
+		{"MaxBackoff below MinBackoff", RetryOptions{MinBackoff: 2 * time.Minute, MaxBackoff: time.Second}, 3, 2 * time.Minute},
+		{"MaxBackoff below MinBackoff under the default cap", RetryOptions{MinBackoff: 10 * time.Second, MaxBackoff: 5 * time.Second}, 3, 10 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.options.withDefaults().delay(test.attempt)
+			if got != test.want {
+				t.Errorf("attempt %d waits %v, want %v", test.attempt, got, test.want)
+			}
+		})
+	}
+}
+
+// publishTestMessage publishes msg as JSON to the exchange the tests
+// subscribe to.
+func publishTestMessage(t *testing.T, channel Channel, msg testMessage) {
+	t.Helper()
+	body, _ := json.Marshal(msg)
+	err := channel.PublishWithContext(context.Background(), testExchange, testKey, false, false, amqp.Publishing{
+		ContentType: ContentTypeJSON,
+		Body:        body,
+	})
+	if err != nil {
+		t.Fatalf("could not publish: %v", err)
+	}
+}
+
+func TestRetryRequeuesWhenRepublishIsNacked(t *testing.T) {
+	broker, channel := newSubscribeTest(t)
+	handled := make(chan struct{}, 10)
+	subscribeTest(t, nackingBroker{broker}, func(testMessage) AckType {
+		handled <- struct{}{}
+		return RetryLater
+	})
+	publishTestMessage(t, channel, testMessage{Key: "a"})
+
+	// without a confirmed copy in the retry queue, the original must be
+	// requeued rather than acked
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handler ran %d times, want the nacked retry redelivered", i)
+		}
+	}
+}
+
+func TestSharedRetryQueuesExpire(t *testing.T) {
+	broker, channel := newSubscribeTest(t)
+	handled := make(chan int, 10)
+	attempts := 0
+	ctx, cancel := context.WithCancel(context.Background())
+	subscription, err := Subscribe(ctx, broker, testExchange, testQueue, testKey, SimpleQueueShared, func(testMessage) AckType {
+		attempts++
+		handled <- attempts
+		if attempts == 1 {
+			return RetryLater
+		}
+		return Ack
+	}, WithRetry(RetryOptions{MinBackoff: 10 * time.Millisecond}))
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		<-subscription.Done()
+	})
+	publishTestMessage(t, channel, testMessage{Key: "a"})
+
+	for want := 1; want <= 2; want++ {
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handler ran %d times, want the message retried", want-1)
+		}
+	}
+
+	memory := broker.(*memoryConnection).broker
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	queue, ok := memory.queues[testQueue+".retry.10"]
+	if !ok {
+		t.Fatal("retry queue was not declared")
+	}
+	want := retryQueueExpiry(10 * time.Millisecond).Milliseconds()
+	if queue.autoDelete || queue.args["x-expires"] != want {
+		t.Errorf("retry queue has auto-delete %v and x-expires %v, want x-expires %d", queue.autoDelete, queue.args["x-expires"], want)
+	}
+}
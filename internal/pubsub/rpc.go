@@ -0,0 +1,301 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/routing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const defaultCallTimeout = 10 * time.Second
+
+var ErrReplyQueueLost = errors.New("reply queue was closed before the reply arrived")
+
+// RemoteError is returned by Call when the server handler failed.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote error: " + e.Message
+}
+
+type CallerOptions struct {
+	// Timeout bounds calls whose context has no deadline. It defaults to 10
+	// seconds.
+	Timeout time.Duration
+}
+
+// Caller sends requests for Call and receives their replies on a private,
+// server-named reply queue. Requests are published with confirms and the
+// mandatory flag, so a call without any server fails right away instead of
+// timing out. It is safe for concurrent use.
+type Caller struct {
+	broker    Broker
+	publisher *Publisher
+	options   CallerOptions
+
+	mu      sync.Mutex
+	channel Channel
+	queue   string
+	pending map[string]chan amqp.Delivery
+	closed  bool
+}
+
+func NewCaller(broker Broker, options CallerOptions) *Caller {
+	if options.Timeout <= 0 {
+		options.Timeout = defaultCallTimeout
+	}
+	return &Caller{
+		broker:    broker,
+		publisher: NewPublisher(broker, PublisherOptions{Confirm: true}),
+		options:   options,
+		pending:   map[string]chan amqp.Delivery{},
+	}
+}
+
+// Call publishes req and waits for the reply of the server, decoding it with
+// the codec registered for its content type. The request expires in the
+// server queue once the call has timed out. The reply carries the message ID
+// of the request as its correlation ID, while the request itself keeps the
+// correlation ID of ctx.
+func Call[Req, Resp any](ctx context.Context, caller *Caller, exchange string, key routing.RoutingKey, req Req, options ...PublishOption) (Resp, error) {
+	var resp Resp
+
+	o := publishOptions{codec: JSONCodec{}}
+	for _, option := range options {
+		option(&o)
+	}
+	body, err := o.codec.Marshal(req)
+	if err != nil {
+		return resp, fmt.Errorf("error encoding %s: %v", o.codec.ContentType(), err)
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, caller.options.Timeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	id := newID()
+	replyQueue, replies, err := caller.register(ctx, id)
+	if err != nil {
+		return resp, err
+	}
+	defer caller.unregister(id)
+
+	err = caller.publisher.Publish(ctx, exchange, string(key), amqp.Publishing{
+		Headers:       withSchema[Req](o.headers),
+		ContentType:   o.codec.ContentType(),
+		CorrelationId: o.correlationID,
+		MessageId:     id,
+		ReplyTo:       replyQueue,
+		Expiration:    fmt.Sprint(max(time.Until(deadline).Milliseconds(), 1)),
+		Body:          body,
+	})
+	if err != nil {
+		return resp, fmt.Errorf("error publishing request: %w", err)
+	}
+
+	select {
+	case reply, ok := <-replies:
+		if !ok {
+			return resp, ErrReplyQueueLost
+		}
+		if message, ok := reply.Headers["x-rpc-error"].(string); ok {
+			return resp, &RemoteError{Message: message}
+		}
+		return decodeSchema[Resp](reply, decodeReply)
+	case <-ctx.Done():
+		return resp, ctx.Err()
+	}
+}
+
+func decodeReply(reply amqp.Delivery, v any) error {
+	codec := Codec(JSONCodec{})
+	if reply.ContentType != "" {
+		var err error
+		codec, err = CodecFor(reply.ContentType)
+		if err != nil {
+			return err
+		}
+	}
+	err := codec.Unmarshal(reply.Body, v)
+	if err != nil {
+		return fmt.Errorf("could not decode %s reply: %v", codec.ContentType(), err)
+	}
+	return nil
+}
+
+// register adds a pending call and returns the reply queue its reply is
+// sent to, declaring the queue if there is none yet.
+func (c *Caller) register(ctx context.Context, id string) (string, chan amqp.Delivery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return "", nil, amqp.ErrClosed
+	}
+	if c.channel == nil {
+		err := c.setup(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	replies := make(chan amqp.Delivery, 1)
+	c.pending[id] = replies
+	return c.queue, replies, nil
+}
+
+func (c *Caller) unregister(id string) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// setup declares an exclusive reply queue and starts consuming it. It is
+// called with c.mu held.
+func (c *Caller) setup(ctx context.Context) error {
+	var channel Channel
+	var err error
+	if managed, ok := c.broker.(*ManagedBroker); ok {
+		channel, err = managed.channel(ctx)
+	} else {
+		channel, err = c.broker.Channel()
+	}
+	if err != nil {
+		return fmt.Errorf("could not open channel: %v", err)
+	}
+
+	queue, err := channel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		channel.Close()
+		return fmt.Errorf("could not declare reply queue: %v", err)
+	}
+	replies, err := channel.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		channel.Close()
+		return fmt.Errorf("could not consume reply queue: %v", err)
+	}
+
+	c.channel = channel
+	c.queue = queue.Name
+	go c.receive(channel, replies)
+	return nil
+}
+
+// receive passes replies to the calls waiting for them. Once the reply queue
+// is gone, for example after a reconnect, the calls still waiting fail and
+// the next call declares a new one.
+func (c *Caller) receive(channel Channel, replies <-chan amqp.Delivery) {
+	for reply := range replies {
+		c.mu.Lock()
+		pending, ok := c.pending[reply.CorrelationId]
+		if ok {
+			delete(c.pending, reply.CorrelationId)
+			pending <- reply
+		}
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.channel != channel {
+		return
+	}
+	channel.Close()
+	c.channel = nil
+	for id, pending := range c.pending {
+		close(pending)
+		delete(c.pending, id)
+	}
+}
+
+// Close fails the calls in progress and deletes the reply queue.
+func (c *Caller) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	channel := c.channel
+	c.mu.Unlock()
+
+	var err error
+	if channel != nil {
+		err = channel.Close()
+	}
+	closeErr := c.publisher.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Serve answers the requests published to the queue with the value returned
+// by handler, encoded with the codec of the request. An error returned by
+// handler is sent back to the caller as a RemoteError. Requests without a
+// reply-to address are handled and acknowledged without a reply.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	broker Broker,
+	publisher *Publisher,
+	exchange string,
+	queueName routing.QueueName,
+	key routing.RoutingKey,
+	simpleQueueType SimpleQueueType,
+	handler func(Envelope[Req]) (Resp, error),
+	options ...SubscribeOption,
+) (*Subscription, error) {
+	return SubscribeEnvelope(
+		ctx,
+		broker,
+		exchange,
+		queueName,
+		key,
+		simpleQueueType,
+		func(envelope Envelope[Req]) AckType {
+			resp, handlerErr := handler(envelope)
+			if envelope.ReplyTo == "" {
+				return Ack
+			}
+
+			reply := amqp.Publishing{
+				ContentType:   envelope.ContentType,
+				CorrelationId: envelope.MessageID,
+			}
+			if handlerErr != nil {
+				reply.Headers = amqp.Table{"x-rpc-error": handlerErr.Error()}
+			} else {
+				reply.Headers = SchemaHeaders[Resp]()
+				codec := Codec(JSONCodec{})
+				if envelope.ContentType != "" {
+					// the request was decoded, so its codec is registered
+					codec, _ = CodecFor(envelope.ContentType)
+				}
+				body, err := codec.Marshal(resp)
+				if err != nil {
+					reply.Headers = amqp.Table{"x-rpc-error": fmt.Sprintf("could not encode reply: %v", err)}
+					body = nil
+				}
+				reply.ContentType = codec.ContentType()
+				reply.Body = body
+			}
+
+			replyCtx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+			defer cancel()
+			err := publisher.Publish(replyCtx, "", envelope.ReplyTo, reply)
+			if err != nil {
+				// the caller times out, answering again would not help
+				log.Printf("could not reply to %s: %v", envelope.ReplyTo, err)
+			}
+			return Ack
+		},
+		options...,
+	)
+}
@@ -0,0 +1,168 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRPCKey = "test_rpc"
+
+// newRPCTest serves testMessage requests on one connection and returns a
+// caller on another connection to the same broker. The handler answers with
+// the request, fails for the key "fail" and is slow for the key "slow".
+func newRPCTest(t *testing.T) *Caller {
+	t.Helper()
+	server, _ := newSubscribeTest(t)
+	publisher := NewPublisher(server, PublisherOptions{Confirm: true})
+	t.Cleanup(func() { publisher.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	subscription, err := Serve(ctx, server, publisher, testExchange, testRPCKey, testRPCKey, SimpleQueueTransient,
+		func(envelope Envelope[testMessage]) (testMessage, error) {
+			request := envelope.Payload
+			switch request.Key {
+			case "fail":
+				return testMessage{}, errors.New("request failed")
+			case "slow":
+				time.Sleep(200 * time.Millisecond)
+			}
+			request.Sequence++
+			return request, nil
+		},
+	)
+	if err != nil {
+		t.Fatalf("could not serve: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		<-subscription.Done()
+	})
+
+	client, err := server.(*memoryConnection).broker.Connect()
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	caller := NewCaller(client, CallerOptions{Timeout: 5 * time.Second})
+	t.Cleanup(func() { caller.Close() })
+	return caller
+}
+
+func TestCallReply(t *testing.T) {
+	caller := newRPCTest(t)
+	for i := 0; i < 3; i++ {
+		reply, err := Call[testMessage, testMessage](context.Background(), caller, testExchange, testRPCKey, testMessage{Key: "echo", Sequence: i})
+		if err != nil {
+			t.Fatalf("call %d failed: %v", i, err)
+		}
+		if reply.Key != "echo" || reply.Sequence != i+1 {
+			t.Errorf("call %d got %+v, want the reply to it", i, reply)
+		}
+	}
+}
+
+func TestCallRemoteError(t *testing.T) {
+	caller := newRPCTest(t)
+	_, err := Call[testMessage, testMessage](context.Background(), caller, testExchange, testRPCKey, testMessage{Key: "fail"})
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Message != "request failed" {
+		t.Fatalf("got %v, want the RemoteError of the handler", err)
+	}
+
+	// the caller is still usable
+	_, err = Call[testMessage, testMessage](context.Background(), caller, testExchange, testRPCKey, testMessage{Key: "echo"})
+	if err != nil {
+		t.Errorf("call after a remote error failed: %v", err)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	caller := newRPCTest(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := Call[testMessage, testMessage](ctx, caller, testExchange, testRPCKey, testMessage{Key: "slow"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	// the late reply of the slow call is not taken for the next one
+	reply, err := Call[testMessage, testMessage](context.Background(), caller, testExchange, testRPCKey, testMessage{Key: "echo", Sequence: 7})
+	if err != nil || reply.Key != "echo" || reply.Sequence != 8 {
+		t.Errorf("call after a timeout got %+v, %v", reply, err)
+	}
+}
+
+func TestCallWithoutServer(t *testing.T) {
+	caller := newRPCTest(t)
+	start := time.Now()
+	_, err := Call[testMessage, testMessage](context.Background(), caller, testExchange, "nobody", testMessage{Key: "echo"})
+	var returned *ReturnedError
+	if !errors.As(err, &returned) {
+		t.Fatalf("got %v, want a ReturnedError", err)
+	}
+	if !strings.Contains(returned.ReplyText, "NO_ROUTE") {
+		t.Errorf("got reply text %q, want NO_ROUTE", returned.ReplyText)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("call without a server took %v instead of failing right away", elapsed)
+	}
+}
+
+func TestServeFromSeveralConnections(t *testing.T) {
+	first, _ := newSubscribeTest(t)
+	memory := first.(*memoryConnection).broker
+
+	serve := func(broker Broker, name string) *Subscription {
+		t.Helper()
+		publisher := NewPublisher(broker, PublisherOptions{Confirm: true})
+		t.Cleanup(func() { publisher.Close() })
+		subscription, err := Serve(context.Background(), broker, publisher, testExchange, testRPCKey, testRPCKey, SimpleQueueShared,
+			func(Envelope[testMessage]) (testMessage, error) {
+				return testMessage{Key: name}, nil
+			},
+			WithSingleActiveConsumer(),
+		)
+		if err != nil {
+			t.Fatalf("server %s could not serve: %v", name, err)
+		}
+		t.Cleanup(func() { subscription.Close(context.Background()) })
+		return subscription
+	}
+	active := serve(first, "first")
+	second, err := memory.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { second.Close() })
+	serve(second, "second")
+
+	client, err := memory.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	caller := NewCaller(client, CallerOptions{Timeout: 5 * time.Second})
+	t.Cleanup(func() { caller.Close() })
+
+	call := func() string {
+		t.Helper()
+		reply, err := Call[testMessage, testMessage](context.Background(), caller, testExchange, testRPCKey, testMessage{})
+		if err != nil {
+			t.Fatalf("call failed: %v", err)
+		}
+		return reply.Key
+	}
+	for i := 0; i < 5; i++ {
+		if server := call(); server != "first" {
+			t.Fatalf("call %d was answered by the %s server, want only the active one", i, server)
+		}
+	}
+
+	active.Close(context.Background())
+	if server := call(); server != "second" {
+		t.Errorf("after the active server stopped, the %s server answered", server)
+	}
+}
@@ -0,0 +1,169 @@
+package pubsub
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Messages of a registered schema are published with their schema name and
+// version in these headers. A message without a version header was published
+// before versioning and counts as version 1.
+const (
+	SchemaHeader        = "x-schema"
+	SchemaVersionHeader = "x-schema-version"
+)
+
+type schema struct {
+	name    string
+	version int
+	// upcasters migrate a payload of the version they are keyed by to the
+	// next version
+	upcasters map[int]upcaster
+}
+
+type upcaster struct {
+	from   reflect.Type
+	upcast func(any) (any, error)
+}
+
+var (
+	schemasMu     sync.RWMutex
+	schemasByName = map[string]*schema{}
+	schemasByType = map[reflect.Type]*schema{}
+)
+
+func schemaNamed(name string) *schema {
+	s, ok := schemasByName[name]
+	if !ok {
+		s = &schema{name: name, version: 1, upcasters: map[int]upcaster{}}
+		schemasByName[name] = s
+	}
+	return s
+}
+
+// RegisterSchema declares T as the current version of the named schema.
+// Publish stamps messages of type T with it, and Subscribe migrates older
+// versions to T with the registered upcasters.
+func RegisterSchema[T any](name string, version int) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	s := schemaNamed(name)
+	s.version = version
+	schemasByType[reflect.TypeFor[T]()] = s
+}
+
+// RegisterUpcaster registers how payloads of version from of the named schema,
+// decoded as From, are migrated to version from+1, of type To. Upcasters are
+// chained, so the one migrating to the current version has to return the type
+// registered with RegisterSchema.
+func RegisterUpcaster[From, To any](name string, from int, upcast func(From) (To, error)) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	schemaNamed(name).upcasters[from] = upcaster{
+		from: reflect.TypeFor[From](),
+		upcast: func(payload any) (any, error) {
+			old, ok := payload.(From)
+			if !ok {
+				return nil, fmt.Errorf("upcaster from version %d of %s takes %s, not %T", from, name, reflect.TypeFor[From](), payload)
+			}
+			return upcast(old)
+		},
+	}
+}
+
+func schemaFor(t reflect.Type) (*schema, bool) {
+	schemasMu.RLock()
+	defer schemasMu.RUnlock()
+	s, ok := schemasByType[t]
+	return s, ok
+}
+
+// withSchema returns headers with the schema of T added, if it has one. The
+// table passed in is not modified, since it may be shared by several
+// messages.
+func withSchema[T any](headers amqp.Table) amqp.Table {
+	s, ok := schemaFor(reflect.TypeFor[T]())
+	if !ok {
+		return headers
+	}
+	stamped := amqp.Table{}
+	for k, v := range headers {
+		stamped[k] = v
+	}
+	schemasMu.RLock()
+	stamped[SchemaHeader] = s.name
+	stamped[SchemaVersionHeader] = int32(s.version)
+	schemasMu.RUnlock()
+	return stamped
+}
+
+// SchemaHeaders returns the schema headers for a message of type T, or nil if
+// T has no registered schema.
+func SchemaHeaders[T any]() amqp.Table {
+	return withSchema[T](nil)
+}
+
+// decodeSchema decodes a delivery into a T, migrating it first if it was
+// published with an older version of the schema of T.
+func decodeSchema[T any](delivery amqp.Delivery, decode func(amqp.Delivery, any) error) (T, error) {
+	var msg T
+	s, ok := schemaFor(reflect.TypeFor[T]())
+	version := 1
+	if v, present := delivery.Headers[SchemaVersionHeader]; present {
+		version = int(headerInt(delivery.Headers, SchemaVersionHeader))
+		if version < 1 {
+			return msg, fmt.Errorf("invalid schema version %v", v)
+		}
+	}
+	if !ok {
+		err := decode(delivery, &msg)
+		return msg, err
+	}
+
+	schemasMu.RLock()
+	current := s.version
+	if version == current {
+		schemasMu.RUnlock()
+		err := decode(delivery, &msg)
+		return msg, err
+	}
+	if version > current {
+		schemasMu.RUnlock()
+		return msg, fmt.Errorf("%s version %d is newer than the supported version %d", s.name, version, current)
+	}
+	upcasters := make([]upcaster, 0, current-version)
+	for v := version; v < current; v++ {
+		u, ok := s.upcasters[v]
+		if !ok {
+			break
+		}
+		upcasters = append(upcasters, u)
+	}
+	schemasMu.RUnlock()
+
+	if len(upcasters) < current-version {
+		return msg, fmt.Errorf("no upcaster from version %d of %s", version+len(upcasters), s.name)
+	}
+
+	old := reflect.New(upcasters[0].from)
+	err := decode(delivery, old.Interface())
+	if err != nil {
+		return msg, err
+	}
+	payload := old.Elem().Interface()
+	for i, u := range upcasters {
+		payload, err = u.upcast(payload)
+		if err != nil {
+			return msg, fmt.Errorf("could not upcast %s from version %d: %v", s.name, version+i, err)
+		}
+	}
+
+	msg, ok = payload.(T)
+	if !ok {
+		return msg, fmt.Errorf("upcasters of %s return %T, not %s", s.name, payload, reflect.TypeFor[T]())
+	}
+	return msg, nil
+}
@@ -0,0 +1,147 @@
+package pubsub_test
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/speady1445/learn-pub-sub-starter/internal/pubsub"
+	"github.com/speady1445/learn-pub-sub-starter/internal/routing"
+	"github.com/speady1445/learn-pub-sub-starter/internal/schemas"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Fixtures are messages as published by older versions. They are never
+// rewritten, only added for new versions and codecs, so that messages still
+// waiting in queues keep decoding after a schema changed. -write-fixtures
+// writes the missing ones, and is only right for current versions.
+var writeFixtures = flag.Bool("write-fixtures", false, "write missing schema fixtures of current versions to testdata")
+
+// schemaFixture is a message published with a version of its schema, and
+// the value it decodes to with the current version.
+type schemaFixture struct {
+	schema  string
+	version int
+	value   any
+	encode  func(pubsub.Codec) ([]byte, error)
+	decode  func(amqp.Delivery) (any, error)
+}
+
+// fixtureOf returns a fixture of value, published with the given version of
+// the schema of T. normalize, if not nil, prepares a decoded value for
+// comparing, for example by dropping the time zone.
+func fixtureOf[T any](schema string, version int, value T, normalize func(*T)) schemaFixture {
+	return schemaFixture{
+		schema:  schema,
+		version: version,
+		value:   value,
+		encode: func(codec pubsub.Codec) ([]byte, error) {
+			return codec.Marshal(value)
+		},
+		decode: func(delivery amqp.Delivery) (any, error) {
+			msg, err := pubsub.DecodeSchema[T](delivery)
+			if err == nil && normalize != nil {
+				normalize(&msg)
+			}
+			return msg, err
+		},
+	}
+}
+
+var (
+	fixturePlayer = gamelogic.Player{
+		Username: "alice",
+		Units: map[int]gamelogic.Unit{
+			1: {ID: 1, Rank: gamelogic.RankInfantry, Location: "europe"},
+			2: {ID: 2, Rank: gamelogic.RankArtillery, Location: "asia"},
+		},
+	}
+	fixtureDefender = gamelogic.Player{
+		Username: "bob",
+		Units:    map[int]gamelogic.Unit{1: {ID: 1, Rank: gamelogic.RankCavalry, Location: "asia"}},
+	}
+)
+
+var schemaFixtures = []schemaFixture{
+	fixtureOf(schemas.PlayingState, 1, routing.PlayingState{IsPaused: true}, nil),
+	fixtureOf(schemas.GameLog, 1, routing.GameLog{
+		CurrentTime: time.Date(2024, 3, 1, 12, 30, 15, 123456789, time.UTC),
+		Message:     "alice won a war against bob",
+		Username:    "alice",
+	}, func(log *routing.GameLog) {
+		log.CurrentTime = log.CurrentTime.UTC()
+	}),
+	fixtureOf(schemas.ArmyMove, 1, gamelogic.ArmyMove{
+		Player:     fixturePlayer,
+		Units:      []gamelogic.Unit{fixturePlayer.Units[2]},
+		ToLocation: "asia",
+	}, nil),
+	fixtureOf(schemas.RecognitionOfWar, 1, gamelogic.RecognitionOfWar{
+		Attacker: fixturePlayer,
+		Defender: fixtureDefender,
+	}, nil),
+	fixtureOf(schemas.UsernameClaim, 1, routing.UsernameClaim{Username: "alice", Release: true}, nil),
+	fixtureOf(schemas.UsernameClaimResult, 1, routing.UsernameClaimResult{Taken: true}, nil),
+}
+
+// fixtureCodecs are the codecs messages may be published with, by the
+// extension of their fixture files.
+var fixtureCodecs = map[string]pubsub.Codec{
+	"json":    pubsub.JSONCodec{},
+	"gob":     pubsub.GobCodec{},
+	"msgpack": pubsub.MsgPackCodec{},
+	"cbor":    pubsub.CBORCodec{},
+	"gamelog": routing.GameLogCodec{},
+}
+
+func TestSchemaFixtures(t *testing.T) {
+	pubsub.RegisterCodec(routing.GameLogCodec{})
+	schemas.Register()
+
+	for _, fixture := range schemaFixtures {
+		for ext, codec := range fixtureCodecs {
+			if ext == "gamelog" && fixture.schema != schemas.GameLog {
+				continue
+			}
+			path := filepath.Join("testdata", "schemas", fmt.Sprintf("v%d", fixture.version), fixture.schema+"."+ext)
+			t.Run(path, func(t *testing.T) {
+				body, err := os.ReadFile(path)
+				if errors.Is(err, os.ErrNotExist) && *writeFixtures {
+					body, err = fixture.encode(codec)
+					if err != nil {
+						t.Fatalf("could not encode fixture: %v", err)
+					}
+					err = os.MkdirAll(filepath.Dir(path), 0755)
+					if err == nil {
+						err = os.WriteFile(path, body, 0644)
+					}
+				}
+				if err != nil {
+					t.Fatalf("could not read fixture: %v", err)
+				}
+
+				got, err := fixture.decode(amqp.Delivery{
+					ContentType: codec.ContentType(),
+					Headers: amqp.Table{
+						pubsub.SchemaHeader:        fixture.schema,
+						pubsub.SchemaVersionHeader: int32(fixture.version),
+					},
+					Body: body,
+				})
+				if err != nil {
+					t.Fatalf("could not decode: %v", err)
+				}
+				if !reflect.DeepEqual(got, fixture.value) {
+					t.Errorf("got %+v, want %+v", got, fixture.value)
+				}
+			})
+		}
+	}
+}
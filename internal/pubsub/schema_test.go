@@ -0,0 +1,92 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Versions of a test schema: v2 split the name, v3 added a rank.
+type (
+	chainV1 struct{ Name string }
+	chainV2 struct{ First, Last string }
+	chainV3 struct {
+		First, Last string
+		Rank        string
+	}
+)
+
+func init() {
+	RegisterSchema[chainV3]("test_chain", 3)
+	RegisterUpcaster("test_chain", 1, func(old chainV1) (chainV2, error) {
+		first, last, _ := strings.Cut(old.Name, " ")
+		return chainV2{First: first, Last: last}, nil
+	})
+	RegisterUpcaster("test_chain", 2, func(old chainV2) (chainV3, error) {
+		if old.First == "" {
+			return chainV3{}, errors.New("no name")
+		}
+		return chainV3{First: old.First, Last: old.Last, Rank: "infantry"}, nil
+	})
+}
+
+func chainDelivery(t *testing.T, version int32, payload any) amqp.Delivery {
+	t.Helper()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return amqp.Delivery{
+		ContentType: ContentTypeJSON,
+		Headers:     amqp.Table{SchemaHeader: "test_chain", SchemaVersionHeader: version},
+		Body:        body,
+	}
+}
+
+func TestUpcasterChain(t *testing.T) {
+	tests := []struct {
+		name     string
+		delivery amqp.Delivery
+		want     chainV3
+	}{
+		{"v1", chainDelivery(t, 1, chainV1{Name: "Ada Lovelace"}), chainV3{First: "Ada", Last: "Lovelace", Rank: "infantry"}},
+		{"v2", chainDelivery(t, 2, chainV2{First: "Ada", Last: "Lovelace"}), chainV3{First: "Ada", Last: "Lovelace", Rank: "infantry"}},
+		{"v3", chainDelivery(t, 3, chainV3{First: "Ada", Rank: "cavalry"}), chainV3{First: "Ada", Rank: "cavalry"}},
+	}
+	for _, test := range tests {
+		got, err := decodeSchema[chainV3](test.delivery, decodeReply)
+		if err != nil {
+			t.Errorf("%s: could not decode: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	// without a version header a message is version 1
+	unversioned := chainDelivery(t, 1, chainV1{Name: "Grace Hopper"})
+	delete(unversioned.Headers, SchemaVersionHeader)
+	got, err := decodeSchema[chainV3](unversioned, decodeReply)
+	if err != nil || got.Last != "Hopper" {
+		t.Errorf("unversioned message decoded to %+v, %v", got, err)
+	}
+}
+
+func TestUpcasterChainErrors(t *testing.T) {
+	_, err := decodeSchema[chainV3](chainDelivery(t, 1, chainV1{}), decodeReply)
+	if err == nil || !strings.Contains(err.Error(), "from version 2") {
+		t.Errorf("got %v, want the error of the second upcaster", err)
+	}
+	_, err = decodeSchema[chainV3](chainDelivery(t, 4, chainV3{}), decodeReply)
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("got %v for a newer version, want it rejected", err)
+	}
+	_, err = decodeSchema[chainV3](chainDelivery(t, 0, chainV3{}), decodeReply)
+	if err == nil {
+		t.Error("version 0 was decoded")
+	}
+}
@@ -0,0 +1,642 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/routing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	defaultDrainTimeout = 10 * time.Second
+	defaultPrefetch     = 10
+	republishTimeout    = 5 * time.Second
+)
+
+type DecodeFailurePolicy int
+
+const (
+	// DecodeFailureDeadLetter sends undecodable deliveries to the dead-letter
+	// exchange with the decoding error in the x-decode-error header.
+	DecodeFailureDeadLetter DecodeFailurePolicy = iota
+	// DecodeFailureRequeue requeues undecodable deliveries up to a limit
+	// before dead-lettering them.
+	DecodeFailureRequeue
+	// DecodeFailureCallback passes undecodable deliveries to a callback
+	// that decides how to acknowledge them.
+	DecodeFailureCallback
+)
+
+type subscribeOptions struct {
+	consumerTag        string
+	drainTimeout       time.Duration
+	decodeFailure      DecodeFailurePolicy
+	decodeRequeueLimit int
+	decodeFailed       func(amqp.Delivery, error) AckType
+	codec              Codec
+	prefetch           int
+	concurrency        int
+	singleActive       bool
+	orderKey           func(amqp.Delivery, any) string
+	orderType          reflect.Type
+	retry              RetryOptions
+	middleware         []Middleware
+}
+
+type SubscribeOption func(*subscribeOptions)
+
+func WithConsumerTag(tag string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.consumerTag = tag
+	}
+}
+
+// WithPrefetch sets how many unacknowledged deliveries the broker sends
+// ahead. The default is 10, or the concurrency if that is higher.
+func WithPrefetch(count int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.prefetch = count
+	}
+}
+
+// WithConcurrency handles up to workers deliveries at the same time. With
+// more than one worker, deliveries are no longer handled in queue order.
+func WithConcurrency(workers int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.concurrency = workers
+	}
+}
+
+// OrderBy partitions deliveries by the key returned for each message:
+// messages with the same key are handled one after another in queue order,
+// while different keys are handled by up to WithConcurrency workers in
+// parallel. T must be the message type of the subscription. Redelivered
+// messages are handled after the ones that overtook them.
+func OrderBy[T any](key func(T) string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.orderType = reflect.TypeFor[T]()
+		o.orderKey = func(_ amqp.Delivery, msg any) string {
+			return key(msg.(T))
+		}
+	}
+}
+
+// OrderByRoutingKeySuffix works like OrderBy, keyed by the last dot-separated
+// word of the routing key, such as the username in "army_moves.username".
+func OrderByRoutingKeySuffix() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.orderType = nil
+		o.orderKey = func(delivery amqp.Delivery, _ any) string {
+			_, key := originalRoute(delivery)
+			return key[strings.LastIndex(key, ".")+1:]
+		}
+	}
+}
+
+// WithSingleActiveConsumer declares the queue so that the broker delivers to
+// one consumer at a time, across all connections. When it goes away, the next
+// consumer takes over.
+func WithSingleActiveConsumer() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.singleActive = true
+	}
+}
+
+// WithDrainTimeout bounds how long in-flight deliveries may take to finish
+// after the context passed to Subscribe is cancelled.
+func WithDrainTimeout(timeout time.Duration) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.drainTimeout = timeout
+	}
+}
+
+// WithDefaultCodec sets the codec for deliveries without a content type. The
+// default is JSON.
+func WithDefaultCodec(codec Codec) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.codec = codec
+	}
+}
+
+func WithDecodeFailureDeadLetter() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decodeFailure = DecodeFailureDeadLetter
+	}
+}
+
+// WithDecodeFailureRequeue requeues an undecodable delivery at most limit
+// times, counting attempts in the x-decode-attempts header.
+func WithDecodeFailureRequeue(limit int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decodeFailure = DecodeFailureRequeue
+		o.decodeRequeueLimit = limit
+	}
+}
+
+func WithDecodeFailureHandler(handler func(amqp.Delivery, error) AckType) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decodeFailure = DecodeFailureCallback
+		o.decodeFailed = handler
+	}
+}
+
+// Subscription is a running consumer created by Subscribe. It keeps
+// consuming across reconnects of a ManagedBroker until it is closed or its
+// context is cancelled.
+type Subscription struct {
+	exchange        string
+	queueName       string
+	key             string
+	simpleQueueType SimpleQueueType
+	options         subscribeOptions
+	unmarshal       func(amqp.Delivery) (any, error)
+	handle          Handler
+	managed         *ManagedBroker
+	// republisher publishes the copies of deliveries that are dead-lettered,
+	// requeued or retried with extra headers
+	republisher *Publisher
+
+	mu       sync.Mutex
+	channel  Channel
+	stopped  chan struct{}
+	closing  bool
+	inflight sync.WaitGroup
+	done     chan struct{}
+	err      error
+}
+
+// consumer is the channel and queue a subscription consumes from until the
+// next reconnect.
+type consumer struct {
+	channel Channel
+	queue   string
+
+	mu          sync.Mutex
+	retryQueues map[string]time.Time
+}
+
+func newSubscription(exchange, queueName, key string, simpleQueueType SimpleQueueType, options []SubscribeOption) *Subscription {
+	s := &Subscription{
+		exchange:        exchange,
+		queueName:       queueName,
+		key:             key,
+		simpleQueueType: simpleQueueType,
+		options:         subscribeOptions{drainTimeout: defaultDrainTimeout, codec: JSONCodec{}},
+		done:            make(chan struct{}),
+	}
+	for _, option := range options {
+		option(&s.options)
+	}
+	if s.options.consumerTag == "" {
+		s.options.consumerTag = queueName + "." + newID()
+	}
+	s.options.retry = s.options.retry.withDefaults()
+	if s.options.concurrency < 1 {
+		s.options.concurrency = 1
+	}
+	if s.options.prefetch < 1 {
+		s.options.prefetch = max(defaultPrefetch, s.options.concurrency)
+	}
+	return s
+}
+
+func (s *Subscription) start(ctx context.Context, broker Broker) error {
+	s.republisher = NewPublisher(broker, PublisherOptions{Confirm: true})
+	var err error
+	if managed, ok := broker.(*ManagedBroker); ok {
+		s.managed = managed
+		err = managed.register(s)
+	} else {
+		err = s.setup(broker)
+	}
+	if err != nil {
+		s.republisher.Close()
+		return err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			drainCtx, cancel := context.WithTimeout(context.Background(), s.options.drainTimeout)
+			defer cancel()
+			s.Close(drainCtx)
+		case <-s.done:
+		}
+	}()
+	return nil
+}
+
+// setup declares and binds the queue, sets QoS and starts consuming. It is
+// called again by a ManagedBroker after every reconnect.
+func (s *Subscription) setup(broker Broker) error {
+	var args amqp.Table
+	if s.options.singleActive {
+		args = amqp.Table{"x-single-active-consumer": true}
+	}
+	channel, queue, err := declareAndBind(
+		broker,
+		s.exchange,
+		s.queueName,
+		s.key,
+		s.simpleQueueType,
+		args,
+	)
+	if err != nil {
+		return fmt.Errorf("could not declare and bind queue: %v", err)
+	}
+
+	err = channel.Qos(s.options.prefetch, 0, false)
+	if err != nil {
+		channel.Close()
+		return fmt.Errorf("could not set QoS: %v", err)
+	}
+
+	consume_channel, err := channel.Consume(
+		queue.Name,
+		s.options.consumerTag,
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		return fmt.Errorf("could not consume queue: %v", err)
+	}
+
+	stopped := make(chan struct{})
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		channel.Close()
+		return nil
+	}
+	s.channel = channel
+	s.stopped = stopped
+	s.mu.Unlock()
+
+	go s.consume(&consumer{channel: channel, queue: queue.Name}, consume_channel, stopped)
+	return nil
+}
+
+// consume runs the workers until the delivery channel is closed. Acks and
+// republishes from several workers are safe, since channels serialize them.
+func (s *Subscription) consume(c *consumer, deliveries <-chan amqp.Delivery, stopped chan struct{}) {
+	defer close(stopped)
+
+	if s.options.orderKey != nil {
+		s.consumeOrdered(c, deliveries)
+	} else {
+		var workers sync.WaitGroup
+		for i := 0; i < s.options.concurrency; i++ {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				for delivery := range deliveries {
+					if !s.accept(delivery) {
+						continue
+					}
+					msg, err := s.unmarshal(delivery)
+					s.process(c, delivery, msg, err)
+				}
+			}()
+		}
+		workers.Wait()
+	}
+
+	s.mu.Lock()
+	closing := s.closing
+	s.mu.Unlock()
+	if closing {
+		return
+	}
+
+	c.channel.Close()
+	if s.managed == nil {
+		s.finish(fmt.Errorf("consumer for queue %s stopped: %w", s.queueName, amqp.ErrClosed))
+	} else if s.managed.isClosed() {
+		s.finish(amqp.ErrClosed)
+	}
+}
+
+// consumeOrdered decodes deliveries in queue order and passes each one to
+// the worker owning its ordering key, so a key is only ever handled by one
+// worker at a time.
+func (s *Subscription) consumeOrdered(c *consumer, deliveries <-chan amqp.Delivery) {
+	type decoded struct {
+		delivery amqp.Delivery
+		msg      any
+	}
+
+	var workers sync.WaitGroup
+	partitions := make([]chan decoded, s.options.concurrency)
+	for i := range partitions {
+		// no more than prefetch deliveries are unacked, so sending never
+		// blocks on a busy partition
+		partitions[i] = make(chan decoded, s.options.prefetch)
+		workers.Add(1)
+		go func(partition chan decoded) {
+			defer workers.Done()
+			for d := range partition {
+				s.process(c, d.delivery, d.msg, nil)
+			}
+		}(partitions[i])
+	}
+
+	for delivery := range deliveries {
+		if !s.accept(delivery) {
+			continue
+		}
+		msg, err := s.unmarshal(delivery)
+		if err != nil {
+			s.process(c, delivery, nil, err)
+			continue
+		}
+		hash := fnv.New32a()
+		hash.Write([]byte(s.options.orderKey(delivery, msg)))
+		partitions[hash.Sum32()%uint32(len(partitions))] <- decoded{delivery: delivery, msg: msg}
+	}
+
+	for _, partition := range partitions {
+		close(partition)
+	}
+	workers.Wait()
+}
+
+// accept counts the delivery as in flight, or requeues it if the
+// subscription is closing.
+func (s *Subscription) accept(delivery amqp.Delivery) bool {
+	s.mu.Lock()
+	closing := s.closing
+	if !closing {
+		s.inflight.Add(1)
+	}
+	s.mu.Unlock()
+
+	if closing {
+		delivery.Nack(false, true)
+		return false
+	}
+	return true
+}
+
+func (s *Subscription) process(c *consumer, delivery amqp.Delivery, msg any, err error) {
+	defer s.inflight.Done()
+	if err != nil {
+		s.decodeFailed(c, delivery, err)
+		return
+	}
+	message := newMessage(c.queue, delivery, msg)
+	s.settle(c, delivery, s.handle(message), message.headers())
+}
+
+// settle acknowledges the delivery according to ack. Discarded deliveries
+// are dead-lettered with deadLetterHeaders, if there are any.
+func (s *Subscription) settle(c *consumer, delivery amqp.Delivery, ack AckType, deadLetterHeaders amqp.Table) {
+	switch ack {
+	case Ack:
+		delivery.Ack(false)
+
+	case NackRequeue:
+		delivery.Nack(false, true)
+
+	case NackDiscard:
+		if len(deadLetterHeaders) > 0 {
+			s.deadLetter(c, delivery, deadLetterHeaders)
+			return
+		}
+		delivery.Nack(false, false)
+
+	case RetryLater:
+		s.retry(c, delivery)
+	}
+}
+
+// decode unmarshals the body with the codec registered for its content type.
+func (s *Subscription) decode(delivery amqp.Delivery, v any) error {
+	codec := s.options.codec
+	if delivery.ContentType != "" {
+		var err error
+		codec, err = CodecFor(delivery.ContentType)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := codec.Unmarshal(delivery.Body, v)
+	if err != nil {
+		return fmt.Errorf("could not decode %s message: %v", codec.ContentType(), err)
+	}
+	return nil
+}
+
+func (s *Subscription) decodeFailed(c *consumer, delivery amqp.Delivery, err error) {
+	log.Printf("could not decode message from queue %s: %v", c.queue, err)
+
+	switch s.options.decodeFailure {
+	case DecodeFailureCallback:
+		s.settle(c, delivery, s.options.decodeFailed(delivery, err), nil)
+		return
+	case DecodeFailureRequeue:
+		attempts := headerInt(delivery.Headers, "x-decode-attempts")
+		if attempts < int64(s.options.decodeRequeueLimit) {
+			publishing := publishingFrom(delivery)
+			setOrigin(publishing.Headers, delivery, c.queue)
+			publishing.Headers["x-decode-attempts"] = attempts + 1
+			err := s.republish("", c.queue, publishing)
+			if err != nil {
+				log.Printf("could not requeue undecodable message: %v", err)
+				delivery.Nack(false, true)
+				return
+			}
+			delivery.Ack(false)
+			return
+		}
+	}
+
+	s.deadLetter(c, delivery, amqp.Table{"x-decode-error": err.Error()})
+}
+
+// deadLetter republishes the delivery to the dead-letter exchange with extra
+// headers, which a plain nack cannot attach, and acks the original once the
+// copy is confirmed. It falls back to a nack if the republish fails.
+func (s *Subscription) deadLetter(c *consumer, delivery amqp.Delivery, headers amqp.Table) {
+	publishing := publishingFrom(delivery)
+	for k, v := range headers {
+		publishing.Headers[k] = v
+	}
+	setOrigin(publishing.Headers, delivery, c.queue)
+	key, _ := publishing.Headers["x-original-routing-key"].(string)
+
+	err := s.republish(routing.ExchangePerilDLX, key, publishing)
+	if err != nil {
+		log.Printf("could not dead-letter message: %v", err)
+		delivery.Nack(false, false)
+		return
+	}
+	delivery.Ack(false)
+}
+
+// republish publishes a copy of a delivery and waits for the broker to
+// confirm it, so that the delivery is only acked once its copy is safe.
+func (s *Subscription) republish(exchange, key string, publishing amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(context.Background(), republishTimeout)
+	defer cancel()
+	return s.republisher.Publish(ctx, exchange, key, publishing)
+}
+
+// Close stops consuming and waits for in-flight deliveries to be handled.
+// Deliveries that arrive meanwhile are requeued. If ctx expires first, the
+// channel is closed so the broker requeues whatever is still unacked.
+func (s *Subscription) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		select {
+		case <-s.done:
+			return s.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.closing = true
+	channel, stopped := s.channel, s.stopped
+	s.mu.Unlock()
+
+	if s.managed != nil {
+		s.managed.unregister(s)
+	}
+	if channel == nil {
+		s.finish(nil)
+		return nil
+	}
+
+	var err error
+	cancelErr := channel.Cancel(s.options.consumerTag, false)
+	if cancelErr != nil && !errors.Is(cancelErr, amqp.ErrClosed) {
+		err = fmt.Errorf("could not cancel consumer: %v", cancelErr)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		<-stopped
+		s.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("could not drain queue %s: %w", s.queueName, ctx.Err())
+	}
+
+	channel.Close()
+	s.finish(err)
+	return err
+}
+
+// Done is closed once the subscription has stopped for good.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error the subscription stopped with, if any.
+func (s *Subscription) Err() error {
+	<-s.done
+	return s.err
+}
+
+func (s *Subscription) finish(err error) {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return
+	default:
+	}
+	s.closing = true
+	s.err = err
+	close(s.done)
+	s.mu.Unlock()
+
+	s.republisher.Close()
+}
+
+func newID() string {
+	buffer := make([]byte, 16)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		panic(fmt.Sprintf("could not generate id: %v", err))
+	}
+	return hex.EncodeToString(buffer)
+}
+
+// publishingFrom copies the properties of a delivery into a publishing with
+// its own header table.
+func publishingFrom(delivery amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		Expiration:      delivery.Expiration,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		UserId:          delivery.UserId,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	}
+}
+
+// setOrigin records where a delivery was first consumed from, unless an
+// earlier republish already did.
+func setOrigin(headers amqp.Table, delivery amqp.Delivery, queue string) {
+	if _, ok := headers["x-original-queue"]; ok {
+		return
+	}
+	headers["x-original-exchange"] = delivery.Exchange
+	headers["x-original-routing-key"] = delivery.RoutingKey
+	headers["x-original-queue"] = queue
+}
+
+func headerInt(headers amqp.Table, key string) int64 {
+	switch v := headers[key].(type) {
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,355 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/routing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	testExchange   = "test_direct"
+	testQueue      = "test_queue"
+	testKey        = "test"
+	testDeadLetter = "test_dlq"
+)
+
+type testMessage struct {
+	Key      string
+	Sequence int
+}
+
+// newSubscribeTest connects to a new MemoryBroker with the exchange the
+// tests subscribe to and a dead-letter queue behind peril_dlx.
+func newSubscribeTest(t testing.TB) (Broker, Channel) {
+	t.Helper()
+	broker, err := NewMemoryBroker().Connect()
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	t.Cleanup(func() { broker.Close() })
+
+	err = Topology{
+		Exchanges: []ExchangeSpec{
+			{Name: testExchange, Kind: amqp.ExchangeDirect},
+			{Name: routing.ExchangePerilDLX, Kind: amqp.ExchangeFanout},
+		},
+		Queues:   []QueueSpec{{Name: testDeadLetter}},
+		Bindings: []BindingSpec{{Queue: testDeadLetter, Exchange: routing.ExchangePerilDLX}},
+	}.Apply(broker)
+	if err != nil {
+		t.Fatalf("could not apply topology: %v", err)
+	}
+
+	channel, err := broker.Channel()
+	if err != nil {
+		t.Fatalf("could not open channel: %v", err)
+	}
+	return broker, channel
+}
+
+func subscribeTest(t testing.TB, broker Broker, handler func(testMessage) AckType, options ...SubscribeOption) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	subscription, err := Subscribe(ctx, broker, testExchange, testQueue, testKey, SimpleQueueDurable, handler, options...)
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		<-subscription.Done()
+	})
+}
+
+// waitForMessages waits until the queue holds n messages and gets them.
+func waitForMessages(t testing.TB, channel Channel, queue string, n int) []amqp.Delivery {
+	t.Helper()
+	deliveries := []amqp.Delivery{}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(deliveries) < n {
+		delivery, ok, err := channel.Get(queue, true)
+		if err != nil {
+			t.Fatalf("could not get from %s: %v", queue, err)
+		}
+		if ok {
+			deliveries = append(deliveries, delivery)
+			continue
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d messages from %s, want %d", len(deliveries), queue, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return deliveries
+}
+
+// malformed holds a body of each codec that cannot be decoded into a
+// testMessage.
+var malformed = []struct {
+	name        string
+	contentType string
+	body        []byte
+}{
+	{"json", ContentTypeJSON, []byte(`{"Key": "a", "Sequence": `)},
+	{"gob", ContentTypeGob, []byte{0x03, 0xff, 0xff, 0xff, 0x00}},
+}
+
+func publishMalformed(t testing.TB, channel Channel, contentType string, body []byte) {
+	t.Helper()
+	err := channel.PublishWithContext(context.Background(), testExchange, testKey, false, false, amqp.Publishing{
+		ContentType: contentType,
+		MessageId:   "malformed",
+		Body:        body,
+	})
+	if err != nil {
+		t.Fatalf("could not publish: %v", err)
+	}
+}
+
+func unexpectedHandler(t testing.TB) func(testMessage) AckType {
+	return func(msg testMessage) AckType {
+		t.Errorf("handler got undecodable message as %+v", msg)
+		return Ack
+	}
+}
+
+func TestDecodeFailureDeadLetter(t *testing.T) {
+	for _, payload := range malformed {
+		t.Run(payload.name, func(t *testing.T) {
+			broker, channel := newSubscribeTest(t)
+			subscribeTest(t, broker, unexpectedHandler(t))
+			publishMalformed(t, channel, payload.contentType, payload.body)
+
+			dead := waitForMessages(t, channel, testDeadLetter, 1)[0]
+			reason, _ := dead.Headers["x-decode-error"].(string)
+			if reason == "" {
+				t.Errorf("dead-lettered message has no x-decode-error header: %v", dead.Headers)
+			}
+			if dead.Headers["x-original-queue"] != testQueue || dead.Headers["x-original-routing-key"] != testKey {
+				t.Errorf("got origin %v with key %v, want %s with key %s", dead.Headers["x-original-queue"], dead.Headers["x-original-routing-key"], testQueue, testKey)
+			}
+			if string(dead.Body) != string(payload.body) || dead.MessageId != "malformed" {
+				t.Errorf("dead-lettered message was changed: %q with ID %q", dead.Body, dead.MessageId)
+			}
+		})
+	}
+}
+
+func TestDecodeFailureRequeue(t *testing.T) {
+	const limit = 3
+	for _, payload := range malformed {
+		t.Run(payload.name, func(t *testing.T) {
+			broker, channel := newSubscribeTest(t)
+			subscribeTest(t, broker, unexpectedHandler(t), WithDecodeFailureRequeue(limit))
+			publishMalformed(t, channel, payload.contentType, payload.body)
+
+			dead := waitForMessages(t, channel, testDeadLetter, 1)[0]
+			if attempts := headerInt(dead.Headers, "x-decode-attempts"); attempts != limit {
+				t.Errorf("dead-lettered after %d requeues, want %d", attempts, limit)
+			}
+			if _, ok := dead.Headers["x-decode-error"].(string); !ok {
+				t.Errorf("dead-lettered message has no x-decode-error header: %v", dead.Headers)
+			}
+			if dead.Headers["x-original-queue"] != testQueue {
+				t.Errorf("got original queue %v, want %s", dead.Headers["x-original-queue"], testQueue)
+			}
+		})
+	}
+}
+
+func TestDecodeFailureCallback(t *testing.T) {
+	for _, payload := range malformed {
+		for _, ack := range []AckType{Ack, NackDiscard} {
+			t.Run(payload.name+"/"+ack.String(), func(t *testing.T) {
+				broker, channel := newSubscribeTest(t)
+				failures := make(chan error, 1)
+				subscribeTest(t, broker, unexpectedHandler(t), WithDecodeFailureHandler(func(delivery amqp.Delivery, err error) AckType {
+					if string(delivery.Body) != string(payload.body) {
+						t.Errorf("callback got body %q, want %q", delivery.Body, payload.body)
+					}
+					failures <- err
+					return ack
+				}))
+				publishMalformed(t, channel, payload.contentType, payload.body)
+
+				select {
+				case err := <-failures:
+					if err == nil {
+						t.Error("callback got no decoding error")
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("callback was not called")
+				}
+
+				if ack == Ack {
+					time.Sleep(50 * time.Millisecond)
+					if got := drain(t, channel, testDeadLetter); len(got) != 0 {
+						t.Errorf("acked message was dead-lettered %d times", len(got))
+					}
+					return
+				}
+				// a plain nack, dead-lettered by the broker
+				dead := waitForMessages(t, channel, testDeadLetter, 1)[0]
+				if dead.Headers["x-first-death-reason"] != "rejected" {
+					t.Errorf("got death reason %v, want rejected", dead.Headers["x-first-death-reason"])
+				}
+				if _, ok := dead.Headers["x-decode-error"]; ok {
+					t.Error("callback decided, but the message got an x-decode-error header")
+				}
+			})
+		}
+	}
+}
+
+func TestOrderByKeepsKeyOrderUnderLoad(t *testing.T) {
+	const (
+		keys       = 50
+		perKey     = 300
+		workers    = 8
+		deliveries = keys * perKey
+	)
+	broker, channel := newSubscribeTest(t)
+
+	var mu sync.Mutex
+	last := map[string]int{}
+	busy := map[string]bool{}
+	handled := make(chan struct{}, deliveries)
+	subscribeTest(t, broker, func(msg testMessage) AckType {
+		mu.Lock()
+		if busy[msg.Key] {
+			t.Errorf("key %s is handled by two workers at once", msg.Key)
+		}
+		busy[msg.Key] = true
+		if msg.Sequence != last[msg.Key]+1 {
+			t.Errorf("key %s: got sequence %d after %d", msg.Key, msg.Sequence, last[msg.Key])
+		}
+		last[msg.Key] = msg.Sequence
+		mu.Unlock()
+
+		// let the workers overtake each other
+		if msg.Sequence%7 == 0 {
+			time.Sleep(time.Duration(msg.Sequence%3) * 100 * time.Microsecond)
+		}
+
+		mu.Lock()
+		busy[msg.Key] = false
+		mu.Unlock()
+		handled <- struct{}{}
+		return Ack
+	}, WithConcurrency(workers), OrderBy(func(msg testMessage) string {
+		return msg.Key
+	}))
+
+	for sequence := 1; sequence <= perKey; sequence++ {
+		for key := 0; key < keys; key++ {
+			body, _ := json.Marshal(testMessage{Key: fmt.Sprintf("player%d", key), Sequence: sequence})
+			err := channel.PublishWithContext(context.Background(), testExchange, testKey, false, false, amqp.Publishing{
+				ContentType: ContentTypeJSON,
+				Body:        body,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	timeout := time.After(30 * time.Second)
+	for i := 0; i < deliveries; i++ {
+		select {
+		case <-handled:
+		case <-timeout:
+			t.Fatalf("handled %d of %d messages", i, deliveries)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for key, sequence := range last {
+		if sequence != perKey {
+			t.Errorf("key %s ended at sequence %d, want %d", key, sequence, perKey)
+		}
+	}
+	if len(last) != keys {
+		t.Errorf("handled %d keys, want %d", len(last), keys)
+	}
+}
+
+// BenchmarkSubscribeConcurrency handles messages with a handler that takes a
+// millisecond, like one writing to disk, with one and with several workers.
+func BenchmarkSubscribeConcurrency(b *testing.B) {
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			broker, channel := newSubscribeTest(b)
+			var handled sync.WaitGroup
+			handled.Add(b.N)
+			subscribeTest(b, broker, func(testMessage) AckType {
+				time.Sleep(time.Millisecond)
+				handled.Done()
+				return Ack
+			}, WithConcurrency(workers))
+			body, _ := json.Marshal(testMessage{Key: "spam"})
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := channel.PublishWithContext(context.Background(), testExchange, testKey, false, false, amqp.Publishing{
+					ContentType: ContentTypeJSON,
+					Body:        body,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			handled.Wait()
+		})
+	}
+}
+
+// nackingBroker opens channels on which the broker nacks every message
+// published instead of routing it. Subscriptions publish only the copies of
+// deliveries they dead-letter, requeue or retry.
+type nackingBroker struct {
+	Broker
+}
+
+func (b nackingBroker) Channel() (Channel, error) {
+	channel, err := b.Broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return &nackingChannel{Channel: channel}, nil
+}
+
+type nackingChannel struct {
+	Channel
+	confirms chan amqp.Confirmation
+}
+
+func (ch *nackingChannel) NotifyPublish(confirms chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.confirms = confirms
+	return confirms
+}
+
+func (ch *nackingChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	go func() { ch.confirms <- amqp.Confirmation{Ack: false} }()
+	return nil
+}
+
+func TestDeadLetterNacksWhenRepublishIsNacked(t *testing.T) {
+	broker, channel := newSubscribeTest(t)
+	subscribeTest(t, nackingBroker{broker}, unexpectedHandler(t))
+	publishMalformed(t, channel, ContentTypeJSON, malformed[0].body)
+
+	// rejected instead of acked, so the queue dead-letters the original
+	dead := waitForMessages(t, channel, testDeadLetter, 1)[0]
+	if dead.Headers["x-first-death-reason"] != "rejected" {
+		t.Errorf("got death reason %v, want rejected", dead.Headers["x-first-death-reason"])
+	}
+	if _, ok := dead.Headers["x-decode-error"]; ok {
+		t.Error("the nacked copy was dead-lettered")
+	}
+}
@@ -0,0 +1,277 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/routing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type ExchangeSpec struct {
+	Name       string
+	Kind       string
+	Durable    bool
+	AutoDelete bool
+	Internal   bool
+	Args       amqp.Table
+}
+
+type QueueSpec struct {
+	Name       routing.QueueName
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Args       amqp.Table
+}
+
+type BindingSpec struct {
+	Queue    routing.QueueName
+	Exchange string
+	Key      routing.RoutingKey
+	Args     amqp.Table
+}
+
+func (b BindingSpec) String() string {
+	return fmt.Sprintf("%s -> %s (%s)", b.Exchange, b.Queue, b.Key)
+}
+
+// ObsoleteQueue is a queue that an earlier version of a topology declared,
+// with the bindings it was declared with.
+type ObsoleteQueue struct {
+	Name     routing.QueueName
+	Bindings []BindingSpec
+}
+
+// Topology is a declarative set of exchanges, queues and bindings. Applying
+// it is idempotent as long as the broker holds no inequivalent declarations.
+type Topology struct {
+	Exchanges []ExchangeSpec
+	Queues    []QueueSpec
+	Bindings  []BindingSpec
+	// Obsolete queues are unbound by Apply, so that no new messages reach
+	// them, and deleted once their remaining messages were consumed.
+	Obsolete []ObsoleteQueue
+}
+
+// BindingInspector reports whether a binding exists. AMQP itself cannot
+// answer this, so it is implemented by the in-memory broker and can be backed
+// by the RabbitMQ management API.
+type BindingInspector interface {
+	BindingExists(binding BindingSpec) (bool, error)
+}
+
+type DiffStatus string
+
+const (
+	DiffOK         DiffStatus = "ok"
+	DiffMissing    DiffStatus = "missing"
+	DiffMismatch   DiffStatus = "mismatch"
+	DiffUnverified DiffStatus = "unverified"
+	// DiffObsolete is an obsolete queue that still exists.
+	DiffObsolete DiffStatus = "obsolete"
+)
+
+type Difference struct {
+	Kind   string
+	Name   string
+	Status DiffStatus
+	Detail string
+}
+
+func (t Topology) Apply(broker Broker) error {
+	channel, err := broker.Channel()
+	if err != nil {
+		return fmt.Errorf("could not open channel: %v", err)
+	}
+	defer channel.Close()
+
+	for _, exchange := range t.Exchanges {
+		err := declareExchange(channel, exchange)
+		if err != nil {
+			return fmt.Errorf("could not declare exchange %s: %w", exchange.Name, err)
+		}
+	}
+	for _, queue := range t.Queues {
+		err := declareQueue(channel, queue)
+		if err != nil {
+			return fmt.Errorf("could not declare queue %s: %w", queue.Name, err)
+		}
+	}
+	for _, binding := range t.Bindings {
+		err := channel.QueueBind(string(binding.Queue), string(binding.Key), binding.Exchange, false, binding.Args)
+		if err != nil {
+			return fmt.Errorf("could not bind %s: %w", binding, err)
+		}
+	}
+
+	for _, queue := range t.Obsolete {
+		err := removeObsolete(broker, queue)
+		if err != nil {
+			return fmt.Errorf("could not remove obsolete queue %s: %w", queue.Name, err)
+		}
+	}
+	return nil
+}
+
+// removeObsolete unbinds the queue and deletes it if it is empty. A queue
+// that still holds messages is left to the consumers of the earlier version,
+// and deleted by a later Apply.
+func removeObsolete(broker Broker, queue ObsoleteQueue) error {
+	var messages int
+	err := withChannel(broker, func(channel Channel) error {
+		state, err := channel.QueueDeclarePassive(string(queue.Name), false, false, false, false, nil)
+		messages = state.Messages
+		return err
+	})
+	if isAMQPError(err, amqp.NotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return withChannel(broker, func(channel Channel) error {
+		for _, binding := range queue.Bindings {
+			err := channel.QueueUnbind(string(queue.Name), string(binding.Key), binding.Exchange, binding.Args)
+			if err != nil {
+				return fmt.Errorf("could not unbind %s: %w", binding, err)
+			}
+		}
+		if messages > 0 {
+			return nil
+		}
+		_, err := channel.QueueDelete(string(queue.Name), false, true, false)
+		return err
+	})
+}
+
+// Diff compares the topology with the broker without creating anything that
+// is missing. Bindings are checked with inspector, or with the broker itself
+// if it implements BindingInspector, and reported as unverified otherwise.
+func (t Topology) Diff(broker Broker, inspector BindingInspector) ([]Difference, error) {
+	if inspector == nil {
+		inspector, _ = broker.(BindingInspector)
+	}
+
+	differences := []Difference{}
+	for _, exchange := range t.Exchanges {
+		exchange := exchange
+		status, detail, err := compare(broker,
+			func(channel Channel) error {
+				return channel.ExchangeDeclarePassive(exchange.Name, exchange.Kind, exchange.Durable, exchange.AutoDelete, exchange.Internal, false, exchange.Args)
+			},
+			func(channel Channel) error {
+				return declareExchange(channel, exchange)
+			},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("could not inspect exchange %s: %v", exchange.Name, err)
+		}
+		differences = append(differences, Difference{Kind: "exchange", Name: exchange.Name, Status: status, Detail: detail})
+	}
+
+	for _, queue := range t.Queues {
+		queue := queue
+		status, detail, err := compare(broker,
+			func(channel Channel) error {
+				_, err := channel.QueueDeclarePassive(string(queue.Name), queue.Durable, queue.AutoDelete, queue.Exclusive, false, queue.Args)
+				return err
+			},
+			func(channel Channel) error {
+				return declareQueue(channel, queue)
+			},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("could not inspect queue %s: %v", queue.Name, err)
+		}
+		differences = append(differences, Difference{Kind: "queue", Name: string(queue.Name), Status: status, Detail: detail})
+	}
+
+	for _, binding := range t.Bindings {
+		difference := Difference{Kind: "binding", Name: binding.String(), Status: DiffUnverified}
+		if inspector != nil {
+			exists, err := inspector.BindingExists(binding)
+			if err != nil {
+				return nil, fmt.Errorf("could not inspect binding %s: %v", binding, err)
+			}
+			difference.Status = DiffOK
+			if !exists {
+				difference.Status = DiffMissing
+			}
+		}
+		differences = append(differences, difference)
+	}
+
+	for _, queue := range t.Obsolete {
+		var state amqp.Queue
+		err := withChannel(broker, func(channel Channel) error {
+			var err error
+			state, err = channel.QueueDeclarePassive(string(queue.Name), false, false, false, false, nil)
+			return err
+		})
+		if isAMQPError(err, amqp.NotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not inspect queue %s: %v", queue.Name, err)
+		}
+		differences = append(differences, Difference{
+			Kind:   "queue",
+			Name:   string(queue.Name),
+			Status: DiffObsolete,
+			Detail: fmt.Sprintf("%d messages left", state.Messages),
+		})
+	}
+	return differences, nil
+}
+
+// compare checks existence with a passive declare, then repeats the
+// declaration: for an existing entity that is a no-op unless its arguments
+// differ, in which case the broker refuses with PRECONDITION_FAILED.
+func compare(broker Broker, passive, declare func(Channel) error) (DiffStatus, string, error) {
+	err := withChannel(broker, passive)
+	if isAMQPError(err, amqp.NotFound) {
+		return DiffMissing, "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	err = withChannel(broker, declare)
+	if isAMQPError(err, amqp.PreconditionFailed) {
+		var amqpErr *amqp.Error
+		errors.As(err, &amqpErr)
+		return DiffMismatch, amqpErr.Reason, nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return DiffOK, "", nil
+}
+
+// withChannel runs fn on a fresh channel, since a failed declaration closes
+// the channel it was made on.
+func withChannel(broker Broker, fn func(Channel) error) error {
+	channel, err := broker.Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+	return fn(channel)
+}
+
+func isAMQPError(err error, code int) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == code
+}
+
+func declareExchange(channel Channel, exchange ExchangeSpec) error {
+	return channel.ExchangeDeclare(exchange.Name, exchange.Kind, exchange.Durable, exchange.AutoDelete, exchange.Internal, false, exchange.Args)
+}
+
+func declareQueue(channel Channel, queue QueueSpec) error {
+	_, err := channel.QueueDeclare(string(queue.Name), queue.Durable, queue.AutoDelete, queue.Exclusive, false, queue.Args)
+	return err
+}
@@ -0,0 +1,117 @@
+package pubsub
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const testObsoleteQueue = "test_obsolete"
+
+func obsoleteTopology() Topology {
+	return Topology{
+		Exchanges: []ExchangeSpec{{Name: testExchange, Kind: amqp.ExchangeDirect}},
+		Queues:    []QueueSpec{{Name: testQueue}},
+		Bindings:  []BindingSpec{{Queue: testQueue, Exchange: testExchange, Key: testKey}},
+		Obsolete: []ObsoleteQueue{{
+			Name:     testObsoleteQueue,
+			Bindings: []BindingSpec{{Queue: testObsoleteQueue, Exchange: testExchange, Key: testKey}},
+		}},
+	}
+}
+
+// obsoleteDifference returns the difference Diff reports for the obsolete
+// queue, if any.
+func obsoleteDifference(t *testing.T, topology Topology, broker Broker) (Difference, bool) {
+	t.Helper()
+	differences, err := topology.Diff(broker, nil)
+	if err != nil {
+		t.Fatalf("could not diff: %v", err)
+	}
+	for _, difference := range differences {
+		if difference.Name == testObsoleteQueue {
+			return difference, true
+		}
+	}
+	return Difference{}, false
+}
+
+func TestApplyDeletesEmptyObsoleteQueue(t *testing.T) {
+	_, broker, channel := newTestChannel(t)
+	topology := obsoleteTopology()
+	err := Topology{Exchanges: topology.Exchanges}.Apply(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	declareBoundQueue(t, channel, testObsoleteQueue, testExchange, testKey, nil)
+
+	difference, ok := obsoleteDifference(t, topology, broker)
+	if !ok || difference.Status != DiffObsolete || difference.Detail != "0 messages left" {
+		t.Errorf("got %+v, want the queue reported as obsolete", difference)
+	}
+
+	err = topology.Apply(broker)
+	if err != nil {
+		t.Fatalf("could not apply: %v", err)
+	}
+	_, err = channel.QueueDeclarePassive(testObsoleteQueue, false, false, false, false, nil)
+	if !isAMQPError(err, amqp.NotFound) {
+		t.Errorf("obsolete queue still exists: %v", err)
+	}
+	if difference, ok := obsoleteDifference(t, topology, broker); ok {
+		t.Errorf("got %+v for a deleted queue", difference)
+	}
+
+	// applying again does not fail on the missing queue
+	err = topology.Apply(broker)
+	if err != nil {
+		t.Errorf("could not apply again: %v", err)
+	}
+}
+
+func TestApplyUnbindsObsoleteQueueWithMessages(t *testing.T) {
+	_, broker, channel := newTestChannel(t)
+	topology := obsoleteTopology()
+	err := Topology{Exchanges: topology.Exchanges}.Apply(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	declareBoundQueue(t, channel, testObsoleteQueue, testExchange, testKey, nil)
+	publishTestMessage(t, channel, testMessage{Key: "a"})
+
+	err = topology.Apply(broker)
+	if err != nil {
+		t.Fatalf("could not apply: %v", err)
+	}
+	exists, err := broker.(BindingInspector).BindingExists(topology.Obsolete[0].Bindings[0])
+	if err != nil || exists {
+		t.Errorf("obsolete queue is still bound: %v", err)
+	}
+
+	// new messages only reach the current queue
+	publishTestMessage(t, channel, testMessage{Key: "b"})
+	state, err := channel.QueueDeclarePassive(testObsoleteQueue, false, false, false, false, nil)
+	if err != nil {
+		t.Fatalf("obsolete queue with a message was deleted: %v", err)
+	}
+	if state.Messages != 1 {
+		t.Errorf("obsolete queue holds %d messages, want the one published before apply", state.Messages)
+	}
+	difference, _ := obsoleteDifference(t, topology, broker)
+	if difference.Status != DiffObsolete || difference.Detail != "1 messages left" {
+		t.Errorf("got %+v, want the queue reported as obsolete with its message", difference)
+	}
+
+	// once the message is consumed, the next apply deletes it
+	_, _, err = channel.Get(testObsoleteQueue, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = topology.Apply(broker)
+	if err != nil {
+		t.Fatalf("could not apply: %v", err)
+	}
+	if difference, ok := obsoleteDifference(t, topology, broker); ok {
+		t.Errorf("got %+v after the queue was emptied", difference)
+	}
+}
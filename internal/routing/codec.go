@@ -0,0 +1,71 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/speady1445/learn-pub-sub-starter/internal/wire"
+)
+
+const ContentTypeGameLog = "application/vnd.peril.gamelog"
+
+// GameLogCodec encodes a GameLog as a compact binary record: the time as
+// seconds and nanoseconds since the Unix epoch, followed by the username and
+// the message, each prefixed with its length. It satisfies pubsub.Codec.
+type GameLogCodec struct{}
+
+func (GameLogCodec) ContentType() string {
+	return ContentTypeGameLog
+}
+
+func (GameLogCodec) Marshal(v any) ([]byte, error) {
+	var gamelog GameLog
+	switch value := v.(type) {
+	case GameLog:
+		gamelog = value
+	case *GameLog:
+		gamelog = *value
+	default:
+		return nil, fmt.Errorf("cannot encode %T as a game log", v)
+	}
+	if uint64(len(gamelog.Username)) > math.MaxUint32 || uint64(len(gamelog.Message)) > math.MaxUint32 {
+		return nil, errors.New("game log is too large")
+	}
+
+	buffer := make([]byte, 0, wire.TimeSize+8+len(gamelog.Username)+len(gamelog.Message))
+	buffer = wire.AppendTime(buffer, gamelog.CurrentTime)
+	buffer = wire.AppendString(buffer, gamelog.Username)
+	buffer = wire.AppendString(buffer, gamelog.Message)
+	return buffer, nil
+}
+
+func (GameLogCodec) Unmarshal(data []byte, v any) error {
+	gamelog, ok := v.(*GameLog)
+	if !ok {
+		return fmt.Errorf("cannot decode a game log into %T", v)
+	}
+
+	currentTime, data, err := wire.ReadTime(data)
+	if err != nil {
+		return fmt.Errorf("game log %v", err)
+	}
+	username, data, err := wire.ReadString(data)
+	if err != nil {
+		return fmt.Errorf("game log %v", err)
+	}
+	message, data, err := wire.ReadString(data)
+	if err != nil {
+		return fmt.Errorf("game log %v", err)
+	}
+	if len(data) != 0 {
+		return fmt.Errorf("game log record has %d trailing bytes", len(data))
+	}
+
+	*gamelog = GameLog{
+		CurrentTime: currentTime,
+		Message:     message,
+		Username:    username,
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// RoutingKey is the routing key a message is published with, or the pattern
+// of a binding. Keys are built by the functions below, so that publishers
+// and subscribers agree on them.
+type RoutingKey string
+
+// QueueName is the name of a queue.
+type QueueName string
+
+var ErrInvalidUsername = errors.New("invalid username")
+
+// ValidateUsername rejects usernames that would change the meaning of the
+// routing keys and patterns they are part of: a "." adds a word, "*" and
+// "#" are wildcards.
+func ValidateUsername(username string) error {
+	if username == "" {
+		return fmt.Errorf("%w: username is empty", ErrInvalidUsername)
+	}
+	if i := strings.IndexAny(username, ".*#"); i >= 0 {
+		return fmt.Errorf("%w: %q contains %q", ErrInvalidUsername, username, username[i])
+	}
+	return nil
+}
+
+// ArmyMovesKey is the routing key of the moves made by a player.
+func ArmyMovesKey(username string) RoutingKey {
+	return RoutingKey(ArmyMovesPrefix + "." + username)
+}
+
+// ArmyMovesPattern matches the moves of every player.
+func ArmyMovesPattern() RoutingKey {
+	return RoutingKey(ArmyMovesPrefix + ".*")
+}
+
+// ArmyMovesQueue is the transient queue a player receives moves on.
+func ArmyMovesQueue(username string) QueueName {
+	return QueueName(ArmyMovesPrefix + "." + username)
+}
+
+// WarRecognitionsKey is the routing key of the wars recognized by a player.
+func WarRecognitionsKey(username string) RoutingKey {
+	return RoutingKey(WarRecognitionsPrefix + "." + username)
+}
+
+// WarRecognitionsPattern matches the wars recognized by every player.
+func WarRecognitionsPattern() RoutingKey {
+	return RoutingKey(WarRecognitionsPrefix + ".*")
+}
+
+// GameLogKey is the routing key of the game logs about a player.
+func GameLogKey(username string) RoutingKey {
+	return RoutingKey(GameLogSlug + "." + username)
+}
+
+// GameLogPattern matches the game logs about every player.
+func GameLogPattern() RoutingKey {
+	return RoutingKey(GameLogSlug + ".*")
+}
+
+// PauseQueue is the transient queue a player receives pause and resume
+// messages on.
+func PauseQueue(username string) QueueName {
+	return QueueName(string(PauseKey) + "." + username)
+}
+
+// IsArmyMovesKey reports whether key was built by ArmyMovesKey.
+func IsArmyMovesKey(key RoutingKey) bool {
+	return MatchTopic(string(ArmyMovesPattern()), string(key))
+}
+
+// IsWarRecognitionsKey reports whether key was built by WarRecognitionsKey.
+func IsWarRecognitionsKey(key RoutingKey) bool {
+	return MatchTopic(string(WarRecognitionsPattern()), string(key))
+}
+
+// IsGameLogKey reports whether key was built by GameLogKey.
+func IsGameLogKey(key RoutingKey) bool {
+	return MatchTopic(string(GameLogPattern()), string(key))
+}
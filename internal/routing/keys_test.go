@@ -0,0 +1,54 @@
+package routing
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		valid    bool
+	}{
+		{"alice", true},
+		{"Alice_42", true},
+		{"élodie", true},
+		{"a-b", true},
+		{"", false},
+		{"alice.bob", false},
+		{".", false},
+		{"alice.", false},
+		{"*", false},
+		{"al*ce", false},
+		{"#", false},
+		{"alice#", false},
+	}
+	for _, test := range tests {
+		err := ValidateUsername(test.username)
+		if test.valid && err != nil {
+			t.Errorf("ValidateUsername(%q) = %v, want it valid", test.username, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidUsername) {
+			t.Errorf("ValidateUsername(%q) = %v, want ErrInvalidUsername", test.username, err)
+		}
+	}
+}
+
+// A valid username keeps the keys built from it to the patterns they are
+// meant for.
+func TestKeysMatchTheirPatterns(t *testing.T) {
+	for _, username := range []string{"alice", "bob_2"} {
+		if !IsArmyMovesKey(ArmyMovesKey(username)) || IsWarRecognitionsKey(ArmyMovesKey(username)) {
+			t.Errorf("army moves key of %s matches the wrong patterns", username)
+		}
+		if !IsWarRecognitionsKey(WarRecognitionsKey(username)) || IsGameLogKey(WarRecognitionsKey(username)) {
+			t.Errorf("war recognitions key of %s matches the wrong patterns", username)
+		}
+		if !IsGameLogKey(GameLogKey(username)) || IsArmyMovesKey(GameLogKey(username)) {
+			t.Errorf("game log key of %s matches the wrong patterns", username)
+		}
+	}
+	if IsArmyMovesKey(ArmyMovesPrefix + ".alice.bob") {
+		t.Error("army moves key with two usernames matches")
+	}
+}
@@ -11,3 +11,14 @@ type GameLog struct {
 	Message     string
 	Username    string
 }
+
+// UsernameClaim asks the server to reserve a username for a client, or to
+// release it again when the client quits.
+type UsernameClaim struct {
+	Username string
+	Release  bool
+}
+
+type UsernameClaimResult struct {
+	Taken bool
+}
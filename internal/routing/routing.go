@@ -5,12 +5,28 @@ const (
 
 	WarRecognitionsPrefix = "war"
 
-	PauseKey = "pause"
+	PauseKey RoutingKey = "pause"
 
 	GameLogSlug = "game_logs"
+
+	UsernamesKey RoutingKey = "usernames"
 )
 
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
+	ExchangePerilDLX    = "peril_dlx"
+)
+
+const (
+	DeadLetterQueue QueueName = "peril_dlq"
+
+	// WarRecognitionsQueue and GameLogQueue are the durable queues shared by
+	// all players and the server.
+	WarRecognitionsQueue QueueName = "war_recognitions"
+	GameLogQueue         QueueName = "game_logs"
+
+	// UsernamesQueue is shared by the servers, and only one of them answers
+	// username claims at a time.
+	UsernamesQueue QueueName = "usernames"
 )
@@ -0,0 +1,46 @@
+package routing
+
+import "strings"
+
+// MatchTopic reports whether a routing key matches an AMQP topic binding
+// pattern, where "*" matches exactly one word and "#" zero or more words.
+// Words may be empty, but an empty key or pattern has no words at all.
+func MatchTopic(pattern, key string) bool {
+	return matchWords(topicWords(pattern), topicWords(key))
+}
+
+func topicWords(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ".")
+}
+
+func matchWords(pattern, key []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case "#":
+			// consecutive "#" match the same as a single one
+			for len(pattern) > 1 && pattern[1] == "#" {
+				pattern = pattern[1:]
+			}
+			for i := 0; i <= len(key); i++ {
+				if matchWords(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(key) == 0 {
+				return false
+			}
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		key = key[1:]
+	}
+	return len(key) == 0
+}
@@ -0,0 +1,68 @@
+package routing
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"army_moves.alice", "army_moves.alice", true},
+		{"army_moves.alice", "army_moves.bob", false},
+		{"army_moves.alice", "army_moves", false},
+
+		{"*", "war", true},
+		{"*", "war.alice", false},
+		{"*", "", false},
+		{"army_moves.*", "army_moves.alice", true},
+		{"army_moves.*", "army_moves", false},
+		{"army_moves.*", "army_moves.alice.bob", false},
+		{"*.alice", "war.alice", true},
+		{"*.*", "war.alice", true},
+		{"*.*", "war", false},
+
+		{"#", "", true},
+		{"#", "war", true},
+		{"#", "war.alice.bob", true},
+		{"game_logs.#", "game_logs", true},
+		{"game_logs.#", "game_logs.alice", true},
+		{"game_logs.#", "game_logs.alice.bob", true},
+		{"game_logs.#", "war.alice", false},
+		{"#.alice", "alice", true},
+		{"#.alice", "war.alice", true},
+		{"#.alice", "war.alice.bob", false},
+		{"war.#.alice", "war.alice", true},
+		{"war.#.alice", "war.x.y.alice", true},
+		{"war.#.alice", "war.x.y.bob", false},
+		{"#.*", "", false},
+		{"#.*", "war", true},
+		{"*.#", "war.alice", true},
+
+		{"#.#", "", true},
+		{"#.#", "war", true},
+		{"#.#", "war.alice.bob", true},
+		{"#.#.alice", "war.alice", true},
+		{"#.#.alice", "war.bob", false},
+
+		// empty words are words like any other
+		{"", "", true},
+		{"", "war", false},
+		{"war", "", false},
+		{"*", ".", false},
+		{"*.*", ".", true},
+		{"war.*", "war.", true},
+		{"war.*.alice", "war..alice", true},
+		{"war..alice", "war..alice", true},
+		{"war..alice", "war.x.alice", false},
+		{"#", "..", true},
+		{"#.", "war.", true},
+		{"#.", "war", false},
+	}
+	for _, test := range tests {
+		got := MatchTopic(test.pattern, test.key)
+		if got != test.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", test.pattern, test.key, got, test.want)
+		}
+	}
+}
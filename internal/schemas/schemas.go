@@ -0,0 +1,39 @@
+package schemas
+
+import (
+	"github.com/speady1445/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/speady1445/learn-pub-sub-starter/internal/pubsub"
+	"github.com/speady1445/learn-pub-sub-starter/internal/routing"
+)
+
+// Schema names, stamped on every message in the x-schema header.
+const (
+	PlayingState        = "playing_state"
+	GameLog             = "game_log"
+	ArmyMove            = "army_move"
+	RecognitionOfWar    = "recognition_of_war"
+	UsernameClaim       = "username_claim"
+	UsernameClaimResult = "username_claim_result"
+)
+
+// Register declares the current version of every message type of the game.
+//
+// To change a message type, bump its version here, keep a copy of the
+// previous struct in this package and register an upcaster from it, for
+// example:
+//
+//	type gameLogV1 struct { ... }
+//
+//	pubsub.RegisterSchema[routing.GameLog](GameLog, 2)
+//	pubsub.RegisterUpcaster(GameLog, 1, func(old gameLogV1) (routing.GameLog, error) { ... })
+//
+// Older clients dead-letter messages of versions newer than theirs instead
+// of misreading them.
+func Register() {
+	pubsub.RegisterSchema[routing.PlayingState](PlayingState, 1)
+	pubsub.RegisterSchema[routing.GameLog](GameLog, 1)
+	pubsub.RegisterSchema[gamelogic.ArmyMove](ArmyMove, 1)
+	pubsub.RegisterSchema[gamelogic.RecognitionOfWar](RecognitionOfWar, 1)
+	pubsub.RegisterSchema[routing.UsernameClaim](UsernameClaim, 1)
+	pubsub.RegisterSchema[routing.UsernameClaimResult](UsernameClaimResult, 1)
+}
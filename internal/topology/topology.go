@@ -0,0 +1,51 @@
+package topology
+
+import (
+	"github.com/speady1445/learn-pub-sub-starter/internal/pubsub"
+	"github.com/speady1445/learn-pub-sub-starter/internal/routing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// legacyWarQueue is where wars were recognized before the queue was renamed
+// to routing.WarRecognitionsQueue.
+const legacyWarQueue routing.QueueName = "war"
+
+// Peril is the broker topology shared by every server and client. Per-player
+// transient queues are declared by the clients themselves.
+func Peril() pubsub.Topology {
+	deadLettered := amqp.Table{
+		"x-dead-letter-exchange": routing.ExchangePerilDLX,
+	}
+
+	return pubsub.Topology{
+		Exchanges: []pubsub.ExchangeSpec{
+			{Name: routing.ExchangePerilDirect, Kind: amqp.ExchangeDirect, Durable: true},
+			{Name: routing.ExchangePerilTopic, Kind: amqp.ExchangeTopic, Durable: true},
+			{Name: routing.ExchangePerilDLX, Kind: amqp.ExchangeFanout, Durable: true},
+		},
+		Queues: []pubsub.QueueSpec{
+			{Name: routing.DeadLetterQueue, Durable: true},
+			{Name: routing.GameLogQueue, Durable: true, Args: deadLettered},
+			{Name: routing.WarRecognitionsQueue, Durable: true, Args: deadLettered},
+		},
+		Bindings: []pubsub.BindingSpec{
+			{Queue: routing.DeadLetterQueue, Exchange: routing.ExchangePerilDLX, Key: ""},
+			{Queue: routing.GameLogQueue, Exchange: routing.ExchangePerilTopic, Key: routing.GameLogPattern()},
+			{Queue: routing.WarRecognitionsQueue, Exchange: routing.ExchangePerilTopic, Key: routing.WarRecognitionsPattern()},
+		},
+	}
+}
+
+// Obsolete lists the queues earlier versions of Peril declared, for
+// peril-topology to remove.
+func Obsolete() []pubsub.ObsoleteQueue {
+	return []pubsub.ObsoleteQueue{
+		{
+			Name: legacyWarQueue,
+			Bindings: []pubsub.BindingSpec{
+				{Queue: legacyWarQueue, Exchange: routing.ExchangePerilTopic, Key: routing.WarRecognitionsPattern()},
+			},
+		},
+	}
+}
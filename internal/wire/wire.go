@@ -0,0 +1,49 @@
+// Package wire encodes the fields of the binary game log formats, the
+// routing.GameLogCodec messages and the game log segments: strings prefixed
+// with their length, and times as seconds and nanoseconds since the Unix
+// epoch. All numbers are big-endian.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var ErrTruncated = errors.New("record is truncated")
+
+// TimeSize is the size of an encoded time.
+const TimeSize = 12
+
+func AppendTime(buffer []byte, t time.Time) []byte {
+	buffer = binary.BigEndian.AppendUint64(buffer, uint64(t.Unix()))
+	return binary.BigEndian.AppendUint32(buffer, uint32(t.Nanosecond()))
+}
+
+// ReadTime decodes the time at the start of data and returns the rest.
+func ReadTime(data []byte) (time.Time, []byte, error) {
+	if len(data) < TimeSize {
+		return time.Time{}, nil, ErrTruncated
+	}
+	seconds := int64(binary.BigEndian.Uint64(data))
+	nanoseconds := int64(binary.BigEndian.Uint32(data[8:]))
+	return time.Unix(seconds, nanoseconds), data[TimeSize:], nil
+}
+
+func AppendString(buffer []byte, s string) []byte {
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(s)))
+	return append(buffer, s...)
+}
+
+// ReadString decodes the string at the start of data and returns the rest.
+func ReadString(data []byte) (string, []byte, error) {
+	if len(data) < 4 {
+		return "", nil, ErrTruncated
+	}
+	n := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	if uint64(len(data)) < uint64(n) {
+		return "", nil, ErrTruncated
+	}
+	return string(data[:n]), data[n:], nil
+}
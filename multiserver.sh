@@ -2,7 +2,7 @@
 
 # Check if the number of instances was provided
 if [ -z "$1" ]; then
-  echo "Usage: $0 <number-of-instances>"
+  echo "Usage: $0 <number-of-instances> [server flags]"
   exit 1
 fi
 
@@ -11,21 +11,29 @@ num_instances=$1
 # Array to store process IDs
 declare -a pids
 
-# Function to kill all processes when Ctrl+C is pressed
+# Build once, so the signals reach the servers instead of "go run"
+bin_dir=$(mktemp -d)
+go build -o "$bin_dir/server" ./cmd/server || exit 1
+
+# Function to stop all processes when Ctrl+C is pressed. The servers finish
+# the game logs they are writing before they exit.
 cleanup() {
   echo "Terminating all instances of ./cmd/server..."
   for pid in "${pids[@]}"; do
     kill -SIGTERM "$pid"
   done
+  wait
+  rm -rf "$bin_dir"
   exit
 }
 
 # Setup trap for SIGINT
 trap 'cleanup' SIGINT
 
-# Start the specified number of instances of the program in the background
+# Start the specified number of instances of the program in the background,
+# each with its own files
 for (( i=0; i<num_instances; i++ )); do
-  go run ./cmd/server &
+  "$bin_dir/server" -instance "$i" "${@:2}" &
   pids+=($!)
 done
 